@@ -5,6 +5,8 @@ import (
 	"log"
 	"net/http"
 
+	"github.com/danielbahrami/se10-mt/internal/analyzer"
+	"github.com/danielbahrami/se10-mt/internal/analyzer/consensus"
 	"github.com/danielbahrami/se10-mt/internal/analyzer/parser"
 	"github.com/danielbahrami/se10-mt/internal/analyzer/regex"
 	"github.com/danielbahrami/se10-mt/internal/api"
@@ -30,17 +32,39 @@ func main() {
 	defer driver.Close(ctx)
 
 	// Create regex and parser analyzers
-	regexAnalyzer := regex.New(ctx, driver)
-	parserAnalyzer := parser.New(ctx, driver)
+	regexAnalyzer := regex.New(driver)
+	parserAnalyzer := parser.New(driver)
+
+	// Create the consensus analyzer, which runs both and records where they disagree
+	consensusAnalyzer := consensus.New(driver, regexAnalyzer, parserAnalyzer, func(d consensus.Disagreement) {
+		go func() {
+			err := postgres.LogDisagreement(ctx, dbpool, d.Principal.OrgID, d.Principal.UserID, d.Query, string(d.Regex.Status), string(d.Parser.Status), rewrittenQuery(d.Regex), rewrittenQuery(d.Parser), d.Regex.Violations, d.Parser.Violations)
+			if err != nil {
+				log.Println(err.Error())
+			}
+		}()
+	})
 
 	// Create ServeMux
 	mux := http.NewServeMux()
 
-	// Setup API routes with both analyzers
-	api.SetupRoutes(mux, dbpool, regexAnalyzer, parserAnalyzer)
+	// Setup API routes with all analyzers
+	api.SetupRoutes(mux, dbpool, api.Analyzers{
+		"regex":     regexAnalyzer,
+		"parser":    parserAnalyzer,
+		"consensus": consensusAnalyzer,
+	})
 
 	// Start the server on port 9090
 	if err := http.ListenAndServe(":9090", mux); err != nil {
 		log.Fatalf("Server failed: %v", err)
 	}
 }
+
+// Returns the query of a rewritten decision, or an empty string for any other decision
+func rewrittenQuery(decision *analyzer.Decision) string {
+	if decision.Status != analyzer.DecisionRewritten {
+		return ""
+	}
+	return decision.Query
+}
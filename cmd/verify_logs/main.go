@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+
+	"github.com/danielbahrami/se10-mt/internal/postgres"
+)
+
+// Verifies the hash chains of the audit log and exits with status 1 if any chain is broken
+func main() {
+	orgId := flag.Int("org", 0, "ID of the organization to verify, 0 verifies every organization")
+	flag.Parse()
+
+	ctx := context.Background()
+
+	// Connect to Postgres
+	dbpool, err := postgres.ConnectPostgres()
+	if err != nil {
+		log.Fatalf("Failed to connect to Postgres: %v", err)
+	}
+	defer dbpool.Close()
+
+	orgIds := []int{*orgId}
+	if *orgId == 0 {
+		orgIds, err = postgres.GetOrganizationIds(ctx, dbpool)
+		if err != nil {
+			log.Fatalf("Failed to list organizations: %v", err)
+		}
+	}
+
+	broken := false
+	for _, id := range orgIds {
+		result, err := postgres.VerifyLogs(ctx, dbpool, id)
+		if err != nil {
+			log.Fatalf("Failed to verify logs of organization %d: %v", id, err)
+		}
+		if result.Valid {
+			log.Printf("Organization %d: %d entries verified, head %s\n", id, result.Entries, result.Head)
+			continue
+		}
+		broken = true
+		log.Printf("Organization %d: chain broken at log %d: %s\n", id, result.BrokenLink.LogID, result.BrokenLink.Reason)
+	}
+
+	if broken {
+		os.Exit(1)
+	}
+}
@@ -3,30 +3,142 @@ package analyzer
 import (
 	"context"
 	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"slices"
 
+	"github.com/danielbahrami/se10-mt/internal/graphdb"
 	"github.com/danielbahrami/se10-mt/internal/postgres"
 	"github.com/neo4j/neo4j-go-driver/v5/neo4j"
 )
 
-// Encapsulates the context and Neo4j driver
+// Encapsulates the Neo4j driver
 type BaseAnalyzer struct {
-	Ctx    context.Context
 	Driver neo4j.DriverWithContext
 }
 
 // Holds the outcome of a query analysis
 type AnalysisResult struct {
 	Allowed    bool
-	Violations []string
+	Violations []Violation
+	Entities   Entities
+}
+
+// The labels, relationship types and properties an analyzer found in a query, lowercased and sorted
+type Entities struct {
+	Labels        []string `json:"labels"`
+	Relationships []string `json:"relationships"`
+	Properties    []string `json:"properties"`
+}
+
+// Returns the entities in the given sets of lowercased names
+func NewEntities(labels, relationships, properties map[string]bool) Entities {
+	return Entities{
+		Labels:        slices.Sorted(maps.Keys(labels)),
+		Relationships: slices.Sorted(maps.Keys(relationships)),
+		Properties:    slices.Sorted(maps.Keys(properties)),
+	}
+}
+
+// Whether a query is executed as is, executed in a rewritten form, or not executed at all
+type DecisionStatus string
+
+const (
+	DecisionAllowed   DecisionStatus = "Allowed"
+	DecisionRewritten DecisionStatus = "Rewritten"
+	DecisionBlocked   DecisionStatus = "Blocked"
+	DecisionCancelled DecisionStatus = "Cancelled" // Allowed or rewritten, but cancelled or timed out while executing
+)
+
+// The user a query is analyzed for
+type Principal struct {
+	UserID      int
+	OrgID       int
+	Permissions *postgres.Permissions
+	Attributes  map[string]any
+}
+
+// The outcome of analyzing a query for a principal, with the query and parameters to execute unless it is blocked
+type Decision struct {
+	Status     DecisionStatus
+	Query      string
+	Parameters map[string]any
+	Violations []Violation
+	Entities   Entities
+	Trace      []string
+}
+
+// Records a step in the decision's trace and logs it
+func (d *Decision) Tracef(format string, args ...any) {
+	step := fmt.Sprintf(format, args...)
+	d.Trace = append(d.Trace, step)
+	log.Println(step)
+}
+
+// Marks the decision as blocked, clearing the query so it cannot be executed
+func (d *Decision) Block() *Decision {
+	d.Status, d.Query, d.Parameters = DecisionBlocked, "", nil
+	return d
+}
+
+// The context key marking an analysis as a dry run
+type dryRunKey struct{}
+
+// Marks analyses under the returned context as dry runs, e.g. explain requests, whose query is never executed
+func WithDryRun(ctx context.Context) context.Context {
+	return context.WithValue(ctx, dryRunKey{}, true)
+}
+
+// Whether the analysis under the context is a dry run
+func IsDryRun(ctx context.Context) bool {
+	dryRun, _ := ctx.Value(dryRunKey{}).(bool)
+	return dryRun
 }
 
 type Analyzer interface {
-	AnalyzeAndExecute(cypher string, perm *postgres.Permissions) ([]map[string]any, bool, string, []string, error)
+	// Decides whether the query may be executed for the principal, without executing it
+	Analyze(ctx context.Context, query string, params map[string]any, principal *Principal) (*Decision, error)
+	// Executes the query of an allowed or rewritten decision, stopping when the context is done
+	Execute(ctx context.Context, decision *Decision, principal *Principal) ([]map[string]any, error)
 }
 
-func NewBaseAnalyzer(ctx context.Context, driver neo4j.DriverWithContext) *BaseAnalyzer {
-	return &BaseAnalyzer{Ctx: ctx, Driver: driver}
+// The query parameter holding the user's attributes, which row filters reference as $user.<key>
+const UserParameter = "user"
+
+// Returns the parameters a rewritten query is executed with, binding the user's attributes next to the client's parameters
+// Missing attributes evaluate to null, so filters that reference them do not match any rows
+func RewriteParameters(params, attributes map[string]any) map[string]any {
+	if attributes == nil {
+		attributes = map[string]any{}
+	}
+	bound := make(map[string]any, len(params)+1)
+	for k, v := range params {
+		bound[k] = v
+	}
+	bound[UserParameter] = attributes
+	return bound
+}
+
+func NewBaseAnalyzer(driver neo4j.DriverWithContext) *BaseAnalyzer {
+	return &BaseAnalyzer{Driver: driver}
+}
+
+// Executes the query of the decision and redacts the results according to the principal's permissions
+// Fails with ForbiddenQueryErr if the query was blocked
+func (b *BaseAnalyzer) Execute(ctx context.Context, decision *Decision, principal *Principal) ([]map[string]any, error) {
+	if decision.Status == DecisionBlocked {
+		return nil, ForbiddenQueryErr
+	}
+
+	log.Printf("Executing %s query...\n", decision.Status)
+	results, err := graphdb.QueryHandler(ctx, b.Driver, decision.Query, decision.Parameters)
+	if err != nil {
+		return nil, fmt.Errorf("execute query: %w", err)
+	}
+
+	return RedactResults(results, principal.Permissions), nil
 }
 
-// Returned when a query is unsafe and rewriting failed
+// Returned when executing the decision of a query that is unsafe and could not be rewritten
 var ForbiddenQueryErr = errors.New("")
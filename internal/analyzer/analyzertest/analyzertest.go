@@ -0,0 +1,20 @@
+package analyzertest
+
+import "github.com/danielbahrami/se10-mt/internal/postgres"
+
+// Patients may be read, employees read and updated, and ssn is not allowed on any label
+func Permissions() *postgres.Permissions {
+	return &postgres.Permissions{
+		AllowedLabels:        []string{"Patient", "Employee"},
+		AllowedRelationships: []string{"TREATS"},
+		AllowedProperties:    map[string][]string{"Patient": {"name", "age"}, "Employee": {"name"}, "TREATS": {"since"}},
+		OperationPermissions: map[string]postgres.OperationPermissions{
+			"Patient":  {Read: true},
+			"Employee": {Read: true, Update: true},
+		},
+		RelationshipOperations: map[string]postgres.OperationPermissions{"TREATS": {Read: true}},
+		DeniedLabels:           []string{"Secret"},
+		AllowedProcedures:      []string{"db.labels"},
+		Strictness:             postgres.StrictnessRewrite,
+	}
+}
@@ -0,0 +1,147 @@
+package consensus
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/danielbahrami/se10-mt/internal/analyzer"
+	"github.com/neo4j/neo4j-go-driver/v5/neo4j"
+)
+
+// Runs the regex and parser analyzers on the same query and applies the stricter of their decisions
+type ConsensusAnalyzer struct {
+	*analyzer.BaseAnalyzer
+	regex  analyzer.Analyzer
+	parser analyzer.Analyzer
+	record func(Disagreement)
+}
+
+var _ analyzer.Analyzer = (*ConsensusAnalyzer)(nil)
+
+// The decisions of the two analyzers for a query they did not agree on, by status, rewritten query or violations
+type Disagreement struct {
+	Principal *analyzer.Principal
+	Query     string
+	Regex     *analyzer.Decision
+	Parser    *analyzer.Decision
+}
+
+// Creates a new Analyzer instance
+// record is called with every disagreement between the analyzers outside dry runs, and may be nil
+func New(driver neo4j.DriverWithContext, regexAnalyzer, parserAnalyzer analyzer.Analyzer, record func(Disagreement)) *ConsensusAnalyzer {
+	return &ConsensusAnalyzer{
+		BaseAnalyzer: analyzer.NewBaseAnalyzer(driver),
+		regex:        regexAnalyzer,
+		parser:       parserAnalyzer,
+		record:       record,
+	}
+}
+
+// How strict each decision is, where the stricter decision wins
+var strictness = map[analyzer.DecisionStatus]int{
+	analyzer.DecisionAllowed:   0,
+	analyzer.DecisionRewritten: 1,
+	analyzer.DecisionBlocked:   2,
+}
+
+func (c *ConsensusAnalyzer) Analyze(ctx context.Context, cypher string, params map[string]any, principal *analyzer.Principal) (*analyzer.Decision, error) {
+	// A query either analyzer cannot analyze is rejected
+	regexDecision, err := c.regex.Analyze(ctx, cypher, params, principal)
+	if err != nil {
+		return nil, err
+	}
+	parserDecision, err := c.parser.Analyze(ctx, cypher, params, principal)
+	if err != nil {
+		return nil, err
+	}
+
+	// The regex analyzer blocks rules only the parser analyzer can check without a verdict on them, so the parser
+	// decides those rules, and the regex decision only counts if it found violations of other rules
+	unchecked := uncheckedKinds(regexDecision.Violations)
+	regexVerdict := len(unchecked) == 0 || slices.ContainsFunc(regexDecision.Violations, func(v analyzer.Violation) bool {
+		return !v.Unsupported
+	})
+
+	// The parser analyzer understands the query, so its decision is used when both are equally strict
+	decision := *parserDecision
+	if regexVerdict && strictness[regexDecision.Status] > strictness[parserDecision.Status] {
+		decision = *regexDecision
+	}
+	decision.Trace = nil
+	for _, step := range regexDecision.Trace {
+		decision.Trace = append(decision.Trace, "Regex: "+step)
+	}
+	for _, step := range parserDecision.Trace {
+		decision.Trace = append(decision.Trace, "Parser: "+step)
+	}
+
+	if reasons := disagreements(regexDecision, parserDecision, unchecked); len(reasons) > 0 {
+		// Rewrites that differ cannot both be applied, so neither is
+		if slices.Contains(reasons, rewritesDiffer) {
+			decision.Block()
+		}
+		decision.Tracef("Analyzers disagree: %s. Applying %s", strings.Join(reasons, ", "), decision.Status)
+		// Dry runs such as explain requests are not recorded, as their queries are never executed
+		if c.record != nil && !analyzer.IsDryRun(ctx) {
+			c.record(Disagreement{Principal: principal, Query: cypher, Regex: regexDecision, Parser: parserDecision})
+		}
+	} else if !regexVerdict {
+		decision.Tracef("Regex analyzer cannot check the query. Applying %s", decision.Status)
+	} else {
+		decision.Tracef("Analyzers agree: %s", decision.Status)
+	}
+
+	return &decision, nil
+}
+
+// The disagreement reason of rewritten queries that differ
+const rewritesDiffer = "rewritten queries differ"
+
+// Returns how the decisions differ, or nothing if they agree on status, rewritten query and violations
+// Violations of the unchecked kinds, which the regex analyzer could not check, are left out along with the status
+func disagreements(regexDecision, parserDecision *analyzer.Decision, unchecked map[analyzer.ViolationKind]bool) []string {
+	var reasons []string
+	if len(unchecked) == 0 {
+		if regexDecision.Status != parserDecision.Status {
+			reasons = append(reasons, fmt.Sprintf("regex decided %s and parser decided %s", regexDecision.Status, parserDecision.Status))
+		} else if regexDecision.Status == analyzer.DecisionRewritten && normalizeQuery(regexDecision.Query) != normalizeQuery(parserDecision.Query) {
+			reasons = append(reasons, rewritesDiffer)
+		}
+	}
+	if !slices.Equal(violationKeys(regexDecision.Violations, unchecked), violationKeys(parserDecision.Violations, unchecked)) {
+		reasons = append(reasons, "violations differ")
+	}
+	return reasons
+}
+
+// Returns the kinds of the violations the analyzer could not check
+func uncheckedKinds(violations []analyzer.Violation) map[analyzer.ViolationKind]bool {
+	kinds := make(map[analyzer.ViolationKind]bool)
+	for _, v := range violations {
+		if v.Unsupported {
+			kinds[v.Kind] = true
+		}
+	}
+	return kinds
+}
+
+// Collapses whitespace, so rewrites that only differ in layout are equal
+func normalizeQuery(query string) string {
+	return strings.Join(strings.Fields(query), " ")
+}
+
+// Returns what each violation is about, lowercased, sorted and without duplicates
+// Spans, variables and messages are left out, as the analyzers report them differently, and so are unchecked kinds
+func violationKeys(violations []analyzer.Violation, unchecked map[analyzer.ViolationKind]bool) []string {
+	keys := make([]string, 0, len(violations))
+	for _, v := range violations {
+		if unchecked[v.Kind] {
+			continue
+		}
+		keys = append(keys, strings.ToLower(strings.Join([]string{string(v.Kind), v.Entity, v.Property, v.Operation}, "|")))
+	}
+	slices.Sort(keys)
+	return slices.Compact(keys)
+}
@@ -0,0 +1,99 @@
+package consensus
+
+import (
+	"context"
+	"io"
+	"log"
+	"os"
+	"testing"
+
+	"github.com/danielbahrami/se10-mt/internal/analyzer"
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// Returns the same decision for every query
+type fixedAnalyzer struct {
+	*analyzer.BaseAnalyzer
+	decision analyzer.Decision
+}
+
+func (f *fixedAnalyzer) Analyze(ctx context.Context, query string, params map[string]any, principal *analyzer.Principal) (*analyzer.Decision, error) {
+	decision := f.decision
+	return &decision, nil
+}
+
+func TestAnalyze(t *testing.T) {
+	allowed := analyzer.Decision{Status: analyzer.DecisionAllowed, Query: "q"}
+	rewritten := analyzer.Decision{Status: analyzer.DecisionRewritten, Query: "r"}
+	blocked := analyzer.Decision{Status: analyzer.DecisionBlocked}
+	ssn := analyzer.Violation{Kind: analyzer.ViolationProperty, Property: "ssn"}
+	unchecked := analyzer.Decision{
+		Status:     analyzer.DecisionBlocked,
+		Violations: []analyzer.Violation{{Kind: analyzer.ViolationProcedure, Unsupported: true}},
+	}
+
+	tests := []struct {
+		name     string
+		regex    analyzer.Decision
+		parser   analyzer.Decision
+		dryRun   bool
+		status   analyzer.DecisionStatus
+		query    string
+		recorded bool
+	}{
+		{name: "agree", regex: allowed, parser: allowed, status: analyzer.DecisionAllowed, query: "q"},
+		{name: "regex stricter", regex: blocked, parser: rewritten, status: analyzer.DecisionBlocked, recorded: true},
+		{name: "parser stricter", regex: allowed, parser: rewritten, status: analyzer.DecisionRewritten, query: "r", recorded: true},
+		{
+			name:     "rewrites differ",
+			regex:    analyzer.Decision{Status: analyzer.DecisionRewritten, Query: "a"},
+			parser:   rewritten,
+			status:   analyzer.DecisionBlocked,
+			recorded: true,
+		},
+		{name: "regex cannot check", regex: unchecked, parser: allowed, status: analyzer.DecisionAllowed, query: "q"},
+		{
+			name:   "regex cannot check all rules",
+			regex:  analyzer.Decision{Status: analyzer.DecisionBlocked, Violations: append([]analyzer.Violation{ssn}, unchecked.Violations...)},
+			parser: analyzer.Decision{Status: analyzer.DecisionRewritten, Query: "r", Violations: []analyzer.Violation{ssn}},
+			status: analyzer.DecisionBlocked,
+		},
+		{
+			name:     "regex cannot check and parser finds a violation",
+			regex:    unchecked,
+			parser:   analyzer.Decision{Status: analyzer.DecisionRewritten, Query: "r", Violations: []analyzer.Violation{ssn}},
+			status:   analyzer.DecisionRewritten,
+			query:    "r",
+			recorded: true,
+		},
+		{name: "dry run", regex: blocked, parser: allowed, dryRun: true, status: analyzer.DecisionBlocked},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorded := false
+			c := New(nil, &fixedAnalyzer{decision: tt.regex}, &fixedAnalyzer{decision: tt.parser}, func(Disagreement) {
+				recorded = true
+			})
+			ctx := context.Background()
+			if tt.dryRun {
+				ctx = analyzer.WithDryRun(ctx)
+			}
+
+			decision, err := c.Analyze(ctx, "q", nil, &analyzer.Principal{})
+			if err != nil {
+				t.Fatalf("Analyze failed: %v", err)
+			}
+			if decision.Status != tt.status || decision.Query != tt.query {
+				t.Errorf("Analyze = %s %q, want %s %q", decision.Status, decision.Query, tt.status, tt.query)
+			}
+			if recorded != tt.recorded {
+				t.Errorf("Analyze recorded a disagreement = %v, want %v", recorded, tt.recorded)
+			}
+		})
+	}
+}
@@ -0,0 +1,135 @@
+package analyzer
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Matches names that can be written without backticks
+var plainName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Matches a unicode escape such as \u0053
+var unicodeEscape = regexp.MustCompile(`\\u([0-9A-Fa-f]{4})`)
+
+// Returns the name an identifier refers to, e.g. Secret for `Secret` or \u0053ecret
+// Both analyzers compare labels, relationship types and property keys by their canonical name
+func CanonicalName(text string) string {
+	if len(text) >= 2 && strings.HasPrefix(text, "`") && strings.HasSuffix(text, "`") {
+		text = strings.ReplaceAll(text[1:len(text)-1], "``", "`")
+	}
+	return decodeEscapes(text)
+}
+
+// Replaces the unicode escapes in the text with the characters they stand for
+func decodeEscapes(text string) string {
+	if !strings.Contains(text, `\u`) {
+		return text
+	}
+	return unicodeEscape.ReplaceAllStringFunc(text, func(escape string) string {
+		code, _ := strconv.ParseUint(escape[2:], 16, 32)
+		return string(rune(code))
+	})
+}
+
+// A query rewritten into a canonical form for pattern matching, which keeps track of where its text came from
+// so that spans found in the normalized text point into the original query
+type NormalizedQuery struct {
+	Text     string
+	original string
+	starts   []int // Offset in the original query of the source of each byte of Text
+	ends     []int // Offset in the original query just after the source of each byte of Text
+}
+
+// Normalizes a query for the regex analyzer by removing comments, unquoting names, decoding escapes and collapsing whitespace
+func NormalizeQuery(cypher string) *NormalizedQuery {
+	q := &NormalizedQuery{original: cypher}
+	var b strings.Builder
+	emit := func(text string, start, end int) {
+		b.WriteString(text)
+		for range len(text) {
+			q.starts = append(q.starts, start)
+			q.ends = append(q.ends, end)
+		}
+	}
+	space := func(start, end int) {
+		if text := b.String(); text != "" && !strings.HasSuffix(text, " ") {
+			emit(" ", start, end)
+		}
+	}
+
+	for i := 0; i < len(cypher); {
+		c := cypher[i]
+		switch {
+		case strings.HasPrefix(cypher[i:], "//"):
+			end := strings.IndexByte(cypher[i:], '\n')
+			if end < 0 {
+				end = len(cypher) - i
+			}
+			space(i, i+end)
+			i += end
+		case strings.HasPrefix(cypher[i:], "/*"):
+			end := strings.Index(cypher[i+2:], "*/")
+			if end < 0 {
+				end = len(cypher) - i
+			} else {
+				end += 4
+			}
+			space(i, i+end)
+			i += end
+		case c == '\'' || c == '"':
+			end := i + 1
+			for end < len(cypher) && cypher[end] != c {
+				if cypher[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			end = min(end+1, len(cypher))
+			emit(cypher[i:end], i, end)
+			i = end
+		case c == '`':
+			end := i + 1
+			for end < len(cypher) {
+				if cypher[end] == '`' {
+					if end+1 < len(cypher) && cypher[end+1] == '`' {
+						end += 2
+						continue
+					}
+					break
+				}
+				end++
+			}
+			end = min(end+1, len(cypher))
+			name := CanonicalName(cypher[i:end])
+			if plainName.MatchString(name) {
+				emit(name, i, end)
+			} else {
+				emit("`"+strings.ReplaceAll(name, "`", "``")+"`", i, end)
+			}
+			i = end
+		case strings.HasPrefix(cypher[i:], `\u`) && unicodeEscape.MatchString(cypher[i:min(i+6, len(cypher))]):
+			emit(decodeEscapes(cypher[i:i+6]), i, i+6)
+			i += 6
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f':
+			space(i, i+1)
+			i++
+		default:
+			_, size := utf8.DecodeRuneInString(cypher[i:])
+			emit(cypher[i:i+size], i, i+size)
+			i += size
+		}
+	}
+
+	q.Text = strings.TrimRight(b.String(), " ")
+	return q
+}
+
+// Returns the span in the original query of the byte range [start, end) of the normalized text
+func (q *NormalizedQuery) SpanAt(start, end int) *Span {
+	if start >= end || end > len(q.Text) {
+		return nil
+	}
+	return SpanAt(q.original, q.starts[start], q.ends[end-1])
+}
@@ -0,0 +1,141 @@
+package analyzer
+
+import (
+	"fmt"
+	"log"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/danielbahrami/se10-mt/internal/postgres"
+)
+
+// The operations a query can perform on a label or relationship type
+const (
+	OperationRead   = "read"
+	OperationCreate = "create"
+	OperationUpdate = "update"
+	OperationDelete = "delete"
+)
+
+// Stand for nodes of any label and relationships of any type, e.g. n in MATCH (n) or the relationships DETACH DELETE
+// removes along with a node
+const (
+	AnyLabel        = "*"
+	AnyRelationship = "*"
+)
+
+// Replaces the placeholder for any label or relationship type with the labels or types the user may access, if any
+func ExpandAny(entities map[string]bool, placeholder string, accessible []string) map[string]bool {
+	if !entities[placeholder] || len(accessible) == 0 {
+		return entities
+	}
+	expanded := make(map[string]bool, len(entities)+len(accessible))
+	for entity := range entities {
+		if entity != placeholder {
+			expanded[entity] = true
+		}
+	}
+	for _, entity := range accessible {
+		expanded[strings.ToLower(entity)] = true
+	}
+	return expanded
+}
+
+// Records the operations a query performs on each label or relationship type it touches, e.g. read and create for MERGE (n:Employee)
+// Maps lowercased entity -> operation -> span of the first clause performing it
+type Operations map[string]map[string]*Span
+
+// Records that the operation is performed on the entity, keeping the span of its first occurrence
+func (o Operations) Add(entity, operation string, span *Span) {
+	entity = strings.ToLower(entity)
+	if o[entity] == nil {
+		o[entity] = make(map[string]*Span)
+	}
+	if _, ok := o[entity][operation]; !ok {
+		o[entity][operation] = span
+	}
+}
+
+// Lists the operations per entity, e.g. "employee: create, read"
+func (o Operations) String() string {
+	entries := make([]string, 0, len(o))
+	for _, entity := range slices.Sorted(maps.Keys(o)) {
+		entries = append(entries, entity+": "+strings.Join(slices.Sorted(maps.Keys(o[entity])), ", "))
+	}
+	return strings.Join(entries, "; ")
+}
+
+// Checks every (label, operation) and (relationship type, operation) pair against the operation permissions of the entity
+// Entities without operation permissions are unrestricted
+func CheckOperations(perm *postgres.Permissions, labels, relationships Operations) []Violation {
+	labelPerms := lowerKeys(perm.OperationPermissions)
+	relPerms := lowerKeys(perm.RelationshipOperations)
+
+	labels = expandOperations(labels, AnyLabel, perm.EffectiveLabels(), labelPerms)
+	relationships = expandOperations(relationships, AnyRelationship, perm.EffectiveRelationships(), relPerms)
+
+	violations := checkOperations(labelPerms, labels, "label", "operation_permissions")
+	return append(violations, checkOperations(relPerms, relationships, "relationship type", "relationship_operations")...)
+}
+
+func lowerKeys(opPerms map[string]postgres.OperationPermissions) map[string]postgres.OperationPermissions {
+	lowered := make(map[string]postgres.OperationPermissions, len(opPerms))
+	for k, v := range opPerms {
+		lowered[strings.ToLower(k)] = v
+	}
+	return lowered
+}
+
+// Returns a copy of the operations in which the operations on the placeholder are performed on each of the entities
+// with operation permissions instead
+func expandOperations(ops Operations, placeholder string, entities []string, opPerms map[string]postgres.OperationPermissions) Operations {
+	anyOps, ok := ops[placeholder]
+	if !ok {
+		return ops
+	}
+
+	expanded := make(Operations, len(ops))
+	for entity, operations := range ops {
+		if entity == placeholder {
+			continue
+		}
+		for operation, span := range operations {
+			expanded.Add(entity, operation, span)
+		}
+	}
+	for _, entity := range entities {
+		if _, restricted := opPerms[strings.ToLower(entity)]; !restricted {
+			continue
+		}
+		for operation, span := range anyOps {
+			expanded.Add(entity, operation, span)
+		}
+	}
+	return expanded
+}
+
+func checkOperations(opPerms map[string]postgres.OperationPermissions, ops Operations, kind, field string) []Violation {
+	var violations []Violation
+	for _, entity := range slices.Sorted(maps.Keys(ops)) {
+		perms, ok := opPerms[entity]
+		if !ok {
+			continue
+		}
+		for _, operation := range slices.Sorted(maps.Keys(ops[entity])) {
+			if perms.Allows(operation) {
+				continue
+			}
+			log.Printf("Operation check failed for %s '%s' for operation '%s'\n", kind, entity, operation)
+			violations = append(violations, Violation{
+				Kind:      ViolationOperation,
+				Entity:    entity,
+				Operation: operation,
+				Span:      ops[entity][operation],
+				RuleID:    fmt.Sprintf("%s[%s]", field, entity),
+				Message:   fmt.Sprintf("operation '%s' is not allowed on %s '%s'", operation, kind, entity),
+			})
+		}
+	}
+	return violations
+}
@@ -0,0 +1,67 @@
+package analyzer
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/danielbahrami/se10-mt/internal/postgres"
+)
+
+func TestCheckOperations(t *testing.T) {
+	perm := &postgres.Permissions{
+		AllowedLabels:        []string{"Employee", "Secret"},
+		AllowedRelationships: []string{"TREATS", "OWNS"},
+		OperationPermissions: map[string]postgres.OperationPermissions{
+			"Employee": {Read: true, Update: true},
+			"Secret":   {Read: true},
+		},
+		RelationshipOperations: map[string]postgres.OperationPermissions{
+			"TREATS": {Read: true, Delete: true},
+			"OWNS":   {Read: true},
+		},
+		DeniedLabels:        []string{"Secret"},
+		DeniedRelationships: []string{"OWNS"},
+	}
+
+	tests := []struct {
+		name          string
+		labels        Operations
+		relationships Operations
+		want          []string // Entities with a violation
+	}{
+		{
+			name:   "allowed operation",
+			labels: Operations{"employee": {OperationUpdate: nil}},
+		},
+		{
+			name:   "disallowed operation",
+			labels: Operations{"employee": {OperationDelete: nil}},
+			want:   []string{"employee"},
+		},
+		{
+			name:          "disallowed relationship operation",
+			relationships: Operations{"treats": {OperationCreate: nil}},
+			want:          []string{"treats"},
+		},
+		{
+			name:   "any label leaves out denied labels",
+			labels: Operations{AnyLabel: {OperationUpdate: nil}},
+		},
+		{
+			name:          "any relationship type leaves out denied types",
+			relationships: Operations{AnyRelationship: {OperationDelete: nil}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, v := range CheckOperations(perm, tt.labels, tt.relationships) {
+				got = append(got, v.Entity)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("CheckOperations violated %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -4,18 +4,19 @@ import (
 	"context"
 	"fmt"
 	"log"
-	"regexp"
+	"maps"
+	"slices"
 	"strings"
 
 	"github.com/antlr4-go/antlr/v4"
 	"github.com/danielbahrami/se10-mt/internal/analyzer"
-	"github.com/danielbahrami/se10-mt/internal/graphdb"
 	"github.com/danielbahrami/se10-mt/internal/parser"
 	"github.com/danielbahrami/se10-mt/internal/postgres"
+	"github.com/danielbahrami/se10-mt/internal/rewriter"
 	"github.com/neo4j/neo4j-go-driver/v5/neo4j"
 )
 
-// Encapsulates the context and Neo4j driver
+// Encapsulates the Neo4j driver
 type ParserAnalyzer struct {
 	*analyzer.BaseAnalyzer
 }
@@ -25,19 +26,57 @@ var _ analyzer.Analyzer = (*ParserAnalyzer)(nil)
 // Holds the outcome of a query analysis
 type AnalysisResult = analyzer.AnalysisResult
 
+// A property lookup such as n.name, along with the variable it is performed on, if any
+type propertyAccess struct {
+	Variable string
+	Property string
+	Value    bool // Whether the lookup is performed on a value, e.g. $props.name
+}
+
+// Properties a query matches or writes by key, e.g. in CREATE (n:Employee {name: 'x'}) or SET n += $props
+type keyedProperties struct {
+	Source    string          // Where the keys come from, for violation messages
+	Variable  string          // Variable of the pattern or SET item, if any
+	Entities  map[string]bool // Labels or relationship types of the pattern
+	Keys      []string        // Keys of a map literal or property expression
+	Parameter string          // Name of the parameter map the keys come from, if any
+	Unknown   bool            // Whether the written keys cannot be determined, e.g. SET n += m
+	Read      bool
+	Write     bool
+	Span      *analyzer.Span
+}
+
+// An operation performed on whatever a variable is bound to, e.g. delete for DELETE n
+type variableOperation struct {
+	Variable  string
+	Operation string
+	Span      *analyzer.Span
+}
+
 type TreeListener struct {
 	*parser.BaseCypherListener
-	labelsFound map[string]bool
-	relFound    map[string]bool
-	propsFound  map[string]bool
-	hasCreate   bool
-	hasUpdate   bool
-	hasDelete   bool
+	labelsFound  map[string]bool
+	relFound     map[string]bool
+	propsFound   map[propertyAccess]bool
+	varLabels    map[string]map[string]bool // Node variable -> labels bound to it in patterns
+	varRelTypes  map[string]map[string]bool // Relationship variable -> types bound to it in patterns
+	labelSpans   map[string]*analyzer.Span  // First occurrence of each label
+	relSpans     map[string]*analyzer.Span  // First occurrence of each relationship type
+	propSpans    map[propertyAccess]*analyzer.Span
+	keyedProps   []keyedProperties
+	labelOps     analyzer.Operations        // Operations performed on labels named in the query
+	relOps       analyzer.Operations        // Operations performed on relationship types named in the query
+	varOps       []variableOperation        // Operations performed on variables
+	pathLabels   map[string]map[string]bool // Path variable -> labels of the nodes in its pattern
+	pathRelTypes map[string]map[string]bool // Path variable -> types of the relationships in its pattern
+	procedures   map[string]*analyzer.Span  // First call of each procedure
+	functions    map[string]*analyzer.Span  // First invocation of each namespaced function
+	plain        map[string]bool            // Variables bound to values or to unlabelled created nodes
 }
 
 // Creates a new Analyzer instance
-func New(ctx context.Context, driver neo4j.DriverWithContext) *ParserAnalyzer {
-	return &ParserAnalyzer{BaseAnalyzer: analyzer.NewBaseAnalyzer(ctx, driver)}
+func New(driver neo4j.DriverWithContext) *ParserAnalyzer {
+	return &ParserAnalyzer{BaseAnalyzer: analyzer.NewBaseAnalyzer(driver)}
 }
 
 func newTreeListener() *TreeListener {
@@ -45,23 +84,89 @@ func newTreeListener() *TreeListener {
 		BaseCypherListener: &parser.BaseCypherListener{},
 		labelsFound:        make(map[string]bool),
 		relFound:           make(map[string]bool),
-		propsFound:         make(map[string]bool),
+		propsFound:         make(map[propertyAccess]bool),
+		varLabels:          make(map[string]map[string]bool),
+		varRelTypes:        make(map[string]map[string]bool),
+		labelSpans:         make(map[string]*analyzer.Span),
+		relSpans:           make(map[string]*analyzer.Span),
+		propSpans:          make(map[propertyAccess]*analyzer.Span),
+		labelOps:           make(analyzer.Operations),
+		relOps:             make(analyzer.Operations),
+		pathLabels:         make(map[string]map[string]bool),
+		pathRelTypes:       make(map[string]map[string]bool),
+		procedures:         make(map[string]*analyzer.Span),
+		functions:          make(map[string]*analyzer.Span),
+		plain:              make(map[string]bool),
 	}
 }
 
-// Returns the ANTLR parse-tree for an input Cypher string
-func parse(input string) antlr.ParseTree {
+// Returns the ANTLR parse-tree for an input Cypher string, or an analyzer.SyntaxError
+func parse(input string) (antlr.ParseTree, error) {
+	errListener := analyzer.NewSyntaxErrorListener()
 	is := antlr.NewInputStream(input)
 	lex := parser.NewCypherLexer(is)
+	lex.RemoveErrorListeners()
+	lex.AddErrorListener(errListener)
 	tokens := antlr.NewCommonTokenStream(lex, 0)
 	p := parser.NewCypherParser(tokens)
+	p.RemoveErrorListeners()
+	p.AddErrorListener(errListener)
 	p.BuildParseTrees = true
-	return p.OC_Cypher()
+	tree := p.OC_Cypher()
+	if err := errListener.Err(); err != nil {
+		return nil, err
+	}
+	return tree, nil
+}
+
+// Records name as bound to variable in the given binding map
+func bind(bindings map[string]map[string]bool, variable, name string) {
+	if bindings[variable] == nil {
+		bindings[variable] = make(map[string]bool)
+	}
+	bindings[variable][name] = true
+}
+
+// Reports whether the variable is bound to anything yet
+func (l *TreeListener) bound(variable string) bool {
+	return l.varLabels[variable] != nil || l.varRelTypes[variable] != nil || l.plain[variable]
+}
+
+// Reports whether the variable is only bound to values or to unlabelled created nodes
+func (l *TreeListener) plainValue(variable string) bool {
+	return l.plain[variable] && l.varLabels[variable] == nil && l.varRelTypes[variable] == nil
+}
+
+// Returns the labels and relationship types the variable may be bound to, with AnyLabel and AnyRelationship if unknown
+func (l *TreeListener) entities(variable string) (map[string]bool, map[string]bool) {
+	labels, relTypes := make(map[string]bool), make(map[string]bool)
+	maps.Copy(labels, l.varLabels[variable])
+	maps.Copy(labels, l.pathLabels[variable])
+	maps.Copy(relTypes, l.varRelTypes[variable])
+	maps.Copy(relTypes, l.pathRelTypes[variable])
+	if len(labels) == 0 && len(relTypes) == 0 && (variable == "" || !l.plain[variable]) {
+		labels[analyzer.AnyLabel] = true
+		relTypes[analyzer.AnyRelationship] = true
+	}
+	return labels, relTypes
 }
 
 func (l *TreeListener) EnterOC_NodePattern(ctx *parser.OC_NodePatternContext) {
+	variable := ""
+	if varCtx := ctx.OC_Variable(); varCtx != nil {
+		variable = varCtx.GetText()
+	}
+
+	// An unlabelled variable matches any label, except in CREATE
 	labelsCtx := ctx.OC_NodeLabels()
 	if labelsCtx == nil {
+		if variable != "" && !l.bound(variable) {
+			if within[*parser.OC_CreateContext](ctx) {
+				l.plain[variable] = true
+			} else {
+				bind(l.varLabels, variable, analyzer.AnyLabel)
+			}
+		}
 		return
 	}
 
@@ -70,8 +175,87 @@ func (l *TreeListener) EnterOC_NodePattern(ctx *parser.OC_NodePatternContext) {
 		if labelNameCtx == nil {
 			continue
 		}
-		name := labelNameCtx.GetText()
-		l.labelsFound[strings.ToLower(name)] = true
+		name := strings.ToLower(analyzer.CanonicalName(labelNameCtx.GetText()))
+		l.labelsFound[name] = true
+		if l.labelSpans[name] == nil {
+			l.labelSpans[name] = analyzer.SpanOf(labelNameCtx)
+		}
+		if variable != "" {
+			bind(l.varLabels, variable, name)
+		}
+		for _, operation := range patternOperations(ctx) {
+			l.labelOps.Add(name, operation, analyzer.SpanOf(labelNameCtx))
+		}
+	}
+}
+
+// Records the labels of label predicates such as n:Secret in WHERE n:Secret
+func (l *TreeListener) EnterOC_NonArithmeticOperatorExpression(ctx *parser.OC_NonArithmeticOperatorExpressionContext) {
+	labelsCtx := ctx.OC_NodeLabels()
+	if labelsCtx == nil {
+		return
+	}
+
+	for _, nodeLabelCtx := range labelsCtx.AllOC_NodeLabel() {
+		labelNameCtx := nodeLabelCtx.OC_LabelName()
+		if labelNameCtx == nil {
+			continue
+		}
+		name := strings.ToLower(analyzer.CanonicalName(labelNameCtx.GetText()))
+		l.labelsFound[name] = true
+		if l.labelSpans[name] == nil {
+			l.labelSpans[name] = analyzer.SpanOf(labelNameCtx)
+		}
+		l.labelOps.Add(name, analyzer.OperationRead, analyzer.SpanOf(labelNameCtx))
+	}
+}
+
+// Returns the operations a pattern performs on its labels and relationship types
+func patternOperations(ctx antlr.Tree) []string {
+	switch {
+	case within[*parser.OC_CreateContext](ctx):
+		return []string{analyzer.OperationCreate}
+	case within[*parser.OC_MergeContext](ctx):
+		return []string{analyzer.OperationRead, analyzer.OperationCreate}
+	default:
+		return []string{analyzer.OperationRead}
+	}
+}
+
+// Binds a path variable such as p in p = (a:Employee)-[:WORKS_ON]->(b) to the labels and relationship types of its pattern
+func (l *TreeListener) ExitOC_PatternPart(ctx *parser.OC_PatternPartContext) {
+	varCtx := ctx.OC_Variable()
+	if varCtx == nil {
+		return
+	}
+	for _, relCtx := range findAll[*parser.OC_RelationshipDetailContext](ctx) {
+		if rtCtxs := relCtx.OC_RelationshipTypes(); rtCtxs != nil {
+			for _, relTypeCtx := range rtCtxs.AllOC_RelTypeName() {
+				bind(l.pathRelTypes, varCtx.GetText(), strings.ToLower(analyzer.CanonicalName(relTypeCtx.GetText())))
+			}
+		}
+		if relVarCtx := relCtx.OC_Variable(); relVarCtx != nil {
+			for relType := range l.varRelTypes[relVarCtx.GetText()] {
+				bind(l.pathRelTypes, varCtx.GetText(), relType)
+			}
+		}
+	}
+	for _, nodeCtx := range findAll[*parser.OC_NodePatternContext](ctx) {
+		for label := range rewriter.PatternLabels(nodeCtx) {
+			bind(l.pathLabels, varCtx.GetText(), label)
+		}
+		if nodeVarCtx := nodeCtx.OC_Variable(); nodeVarCtx != nil {
+			for label := range l.varLabels[nodeVarCtx.GetText()] {
+				bind(l.pathLabels, varCtx.GetText(), label)
+			}
+		} else if nodeCtx.OC_NodeLabels() == nil && !within[*parser.OC_CreateContext](ctx) {
+			bind(l.pathLabels, varCtx.GetText(), analyzer.AnyLabel)
+		}
+	}
+	for _, relCtx := range findAll[*parser.OC_RelationshipPatternContext](ctx) {
+		if detail := relCtx.OC_RelationshipDetail(); detail == nil || (detail.OC_Variable() == nil && detail.OC_RelationshipTypes() == nil) {
+			bind(l.pathRelTypes, varCtx.GetText(), analyzer.AnyRelationship)
+		}
 	}
 }
 
@@ -81,15 +265,33 @@ func (l *TreeListener) EnterOC_RelationshipPattern(ctx *parser.OC_RelationshipPa
 		return
 	}
 
+	variable := ""
+	if varCtx := rd.OC_Variable(); varCtx != nil {
+		variable = varCtx.GetText()
+	}
+
+	// A variable first bound without a type matches relationships of any type
 	rtCtxs := rd.OC_RelationshipTypes()
 	if rtCtxs == nil {
+		if variable != "" && !l.bound(variable) {
+			bind(l.varRelTypes, variable, analyzer.AnyRelationship)
+		}
 		return
 	}
 
 	for _, relTypeCtx := range rtCtxs.AllOC_RelTypeName() {
-		text := relTypeCtx.GetText()
-		rel := strings.TrimPrefix(text, ":")
-		l.relFound[strings.ToLower(rel)] = true
+		text := analyzer.CanonicalName(relTypeCtx.GetText())
+		rel := strings.ToLower(strings.TrimPrefix(text, ":"))
+		l.relFound[rel] = true
+		if l.relSpans[rel] == nil {
+			l.relSpans[rel] = analyzer.SpanOf(relTypeCtx)
+		}
+		if variable != "" {
+			bind(l.varRelTypes, variable, rel)
+		}
+		for _, operation := range patternOperations(ctx) {
+			l.relOps.Add(rel, operation, analyzer.SpanOf(relTypeCtx))
+		}
 	}
 }
 
@@ -99,28 +301,349 @@ func (l *TreeListener) EnterOC_PropertyLookup(ctx *parser.OC_PropertyLookupConte
 		return
 	}
 
-	name := pkCtx.GetText()
-	l.propsFound[strings.ToLower(name)] = true
+	// The targets of SET and REMOVE items are writes, which are checked separately
+	if target, ok := ctx.GetParent().(*parser.OC_PropertyExpressionContext); ok {
+		switch target.GetParent().(type) {
+		case *parser.OC_SetItemContext, *parser.OC_RemoveItemContext:
+			return
+		}
+	}
+
+	name := analyzer.CanonicalName(pkCtx.GetText())
+	access := propertyAccess{Variable: rewriter.LookupVariable(ctx), Property: strings.ToLower(name)}
+	access.Value = access.Variable == "" && onValue(ctx)
+	l.propsFound[access] = true
+	if l.propSpans[access] == nil {
+		l.propSpans[access] = analyzer.SpanOf(pkCtx)
+	}
+}
+
+// Reports whether a property lookup is performed on a value, e.g. a literal, a parameter or another property
+func onValue(ctx *parser.OC_PropertyLookupContext) bool {
+	var previous antlr.Tree
+	for _, child := range ctx.GetParent().GetChildren() {
+		if child == ctx {
+			break
+		}
+		if _, ok := child.(antlr.TerminalNode); !ok {
+			previous = child
+		}
+	}
+
+	switch prev := previous.(type) {
+	case *parser.OC_PropertyLookupContext:
+		return true
+	case *parser.OC_AtomContext:
+		if fn := prev.OC_FunctionInvocation(); fn != nil {
+			return !returnsEntities(fn)
+		}
+		return prev.OC_Literal() != nil || prev.OC_Parameter() != nil || prev.COUNT() != nil || prev.OC_Quantifier() != nil ||
+			prev.OC_PatternPredicate() != nil || prev.OC_ExistentialSubquery() != nil
+	}
+	return false
+}
+
+// Reports whether the function may return nodes or relationships, e.g. startNode(r) or head(list)
+func returnsEntities(fn parser.IOC_FunctionInvocationContext) bool {
+	name := fn.OC_FunctionName()
+	if name.OC_Namespace().GetText() != "" {
+		return true
+	}
+	switch strings.ToLower(analyzer.CanonicalName(name.OC_SymbolicName().GetText())) {
+	case "startnode", "endnode", "head", "last", "coalesce":
+		return true
+	}
+	return false
+}
+
+// Binds the alias of a WITH or RETURN projection item, e.g. p in WITH e AS p
+func (l *TreeListener) ExitOC_ProjectionItem(ctx *parser.OC_ProjectionItemContext) {
+	if varCtx := ctx.OC_Variable(); varCtx != nil {
+		l.bindAlias(varCtx.GetText(), ctx.OC_Expression())
+	}
+}
+
+// Binds the variable of UNWIND to the elements of the list, e.g. x in UNWIND [e] AS x
+func (l *TreeListener) ExitOC_Unwind(ctx *parser.OC_UnwindContext) {
+	if varCtx := ctx.OC_Variable(); varCtx != nil {
+		l.bindAlias(varCtx.GetText(), ctx.OC_Expression())
+	}
+}
+
+// Binds the variable of a list comprehension or quantifier, e.g. x in [x IN collect(e) | x.name]
+func (l *TreeListener) ExitOC_IdInColl(ctx *parser.OC_IdInCollContext) {
+	if varCtx := ctx.OC_Variable(); varCtx != nil {
+		l.bindAlias(varCtx.GetText(), ctx.OC_Expression())
+	}
+}
+
+// Binds the variables a procedure yields, which may be nodes or relationships of any label or type
+func (l *TreeListener) EnterOC_YieldItem(ctx *parser.OC_YieldItemContext) {
+	if varCtx := ctx.OC_Variable(); varCtx != nil {
+		bind(l.varLabels, varCtx.GetText(), analyzer.AnyLabel)
+		bind(l.varRelTypes, varCtx.GetText(), analyzer.AnyRelationship)
+	}
+}
+
+// Binds the alias to the nodes and relationships the expression may evaluate to, or to a value
+func (l *TreeListener) bindAlias(alias string, expr antlr.Tree) {
+	if expr == nil {
+		return
+	}
+
+	entity := false
+	for _, atom := range findAll[*parser.OC_AtomContext](expr) {
+		if atom.OC_Variable() == nil || lookedUp(atom) {
+			continue
+		}
+		labels, relTypes := l.entities(atom.OC_Variable().GetText())
+		for label := range labels {
+			bind(l.varLabels, alias, label)
+		}
+		for relType := range relTypes {
+			bind(l.varRelTypes, alias, relType)
+		}
+		entity = entity || len(labels) > 0 || len(relTypes) > 0
+	}
+	for _, fn := range findAll[*parser.OC_FunctionInvocationContext](expr) {
+		if returnsEntities(fn) {
+			bind(l.varLabels, alias, analyzer.AnyLabel)
+			bind(l.varRelTypes, alias, analyzer.AnyRelationship)
+			entity = true
+		}
+	}
+
+	if !entity && !l.bound(alias) {
+		l.plain[alias] = true
+	}
+}
+
+// Reports whether a property is looked up on the atom, e.g. e in e.name
+func lookedUp(atom *parser.OC_AtomContext) bool {
+	siblings := atom.GetParent().GetChildren()
+	for i, child := range siblings {
+		if child != atom {
+			continue
+		}
+		for _, next := range siblings[i+1:] {
+			if _, ok := next.(antlr.TerminalNode); ok {
+				continue
+			}
+			_, ok := next.(*parser.OC_PropertyLookupContext)
+			return ok
+		}
+	}
+	return false
+}
+
+func (l *TreeListener) EnterOC_Properties(ctx *parser.OC_PropertiesContext) {
+	kp := keyedProperties{Span: analyzer.SpanOf(ctx)}
+	if paramCtx := ctx.OC_Parameter(); paramCtx != nil {
+		kp.Parameter = parameterName(paramCtx)
+		kp.Source = fmt.Sprintf("parameter '%s'", kp.Parameter)
+	} else if mapCtx := ctx.OC_MapLiteral(); mapCtx != nil {
+		kp.Keys = mapKeys(mapCtx)
+		kp.Source = "map literal"
+	}
+
+	// Anonymous unlabelled nodes and untyped relationships match any label or type, except in CREATE
+	inCreate := within[*parser.OC_CreateContext](ctx)
+	switch pattern := ctx.GetParent().(type) {
+	case *parser.OC_NodePatternContext:
+		kp.Entities = rewriter.PatternLabels(pattern)
+		if varCtx := pattern.OC_Variable(); varCtx != nil {
+			kp.Variable = varCtx.GetText()
+		} else if len(kp.Entities) == 0 && !inCreate {
+			kp.Entities[analyzer.AnyLabel] = true
+		}
+	case *parser.OC_RelationshipDetailContext:
+		kp.Entities = make(map[string]bool)
+		if rtCtxs := pattern.OC_RelationshipTypes(); rtCtxs != nil {
+			for _, relTypeCtx := range rtCtxs.AllOC_RelTypeName() {
+				kp.Entities[strings.ToLower(analyzer.CanonicalName(relTypeCtx.GetText()))] = true
+			}
+		}
+		if varCtx := pattern.OC_Variable(); varCtx != nil {
+			kp.Variable = varCtx.GetText()
+		} else if len(kp.Entities) == 0 {
+			kp.Entities[analyzer.AnyRelationship] = true
+		}
+	default:
+		return
+	}
+
+	// CREATE writes the properties, MATCH matches them, and MERGE does either
+	inMerge := within[*parser.OC_MergeContext](ctx)
+	kp.Read = !inCreate
+	kp.Write = inCreate || inMerge
+	l.keyedProps = append(l.keyedProps, kp)
+}
+
+// Records the properties written by SET n.prop = ..., SET n = ... and SET n += ...
+func (l *TreeListener) EnterOC_SetItem(ctx *parser.OC_SetItemContext) {
+	l.updateItem(ctx, ctx.OC_PropertyExpression(), ctx.OC_Variable(), ctx.OC_NodeLabels())
+
+	if propCtx := ctx.OC_PropertyExpression(); propCtx != nil {
+		l.keyedProps = append(l.keyedProps, writtenProperty(propCtx, "SET"))
+		return
+	}
+
+	varCtx, exprCtx := ctx.OC_Variable(), ctx.OC_Expression()
+	if varCtx == nil || exprCtx == nil {
+		return // SET n:Label
+	}
+
+	kp := keyedProperties{Source: "SET", Variable: varCtx.GetText(), Write: true, Span: analyzer.SpanOf(ctx)}
+	if mapCtx, ok := soleChild[*parser.OC_MapLiteralContext](exprCtx); ok {
+		kp.Keys = mapKeys(mapCtx)
+	} else if paramCtx, ok := soleChild[*parser.OC_ParameterContext](exprCtx); ok {
+		kp.Parameter = parameterName(paramCtx)
+		kp.Source = fmt.Sprintf("parameter '%s'", kp.Parameter)
+	} else {
+		kp.Unknown = true
+	}
+	l.keyedProps = append(l.keyedProps, kp)
+}
+
+// Records the property removed by REMOVE n.prop
+func (l *TreeListener) EnterOC_RemoveItem(ctx *parser.OC_RemoveItemContext) {
+	l.updateItem(ctx, ctx.OC_PropertyExpression(), ctx.OC_Variable(), ctx.OC_NodeLabels())
+
+	if propCtx := ctx.OC_PropertyExpression(); propCtx != nil {
+		l.keyedProps = append(l.keyedProps, writtenProperty(propCtx, "REMOVE"))
+	}
+}
+
+// Records a SET or REMOVE item as an update of its variable and of the labels it adds or removes
+func (l *TreeListener) updateItem(ctx antlr.ParserRuleContext, propCtx parser.IOC_PropertyExpressionContext, varCtx parser.IOC_VariableContext, labelsCtx parser.IOC_NodeLabelsContext) {
+	span := analyzer.SpanOf(ctx)
+	if propCtx != nil {
+		if atom := propCtx.OC_Atom(); atom != nil {
+			varCtx = atom.OC_Variable()
+		}
+	}
+	if varCtx != nil {
+		l.varOps = append(l.varOps, variableOperation{Variable: varCtx.GetText(), Operation: analyzer.OperationUpdate, Span: span})
+	}
+	if labelsCtx == nil {
+		return
+	}
+	for _, nodeLabelCtx := range labelsCtx.AllOC_NodeLabel() {
+		if labelNameCtx := nodeLabelCtx.OC_LabelName(); labelNameCtx != nil {
+			name := strings.ToLower(analyzer.CanonicalName(labelNameCtx.GetText()))
+			l.labelsFound[name] = true
+			if l.labelSpans[name] == nil {
+				l.labelSpans[name] = analyzer.SpanOf(labelNameCtx)
+			}
+			l.labelOps.Add(name, analyzer.OperationUpdate, analyzer.SpanOf(labelNameCtx))
+		}
+	}
+}
+
+// Returns the property written by a SET or REMOVE item such as n.name
+func writtenProperty(ctx parser.IOC_PropertyExpressionContext, source string) keyedProperties {
+	kp := keyedProperties{Source: source, Write: true, Span: analyzer.SpanOf(ctx)}
+	if atom := ctx.OC_Atom(); atom != nil && atom.OC_Variable() != nil {
+		kp.Variable = atom.OC_Variable().GetText()
+	}
+	lookups := ctx.AllOC_PropertyLookup()
+	if len(lookups) == 1 && lookups[0].OC_PropertyKeyName() != nil {
+		kp.Keys = []string{analyzer.CanonicalName(lookups[0].OC_PropertyKeyName().GetText())}
+	} else {
+		kp.Unknown = true
+	}
+	return kp
 }
 
-func (l *TreeListener) EnterOC_Create(ctx *parser.OC_CreateContext) {
-	l.hasCreate = true
+// Returns the keys of a map literal
+func mapKeys(ctx parser.IOC_MapLiteralContext) []string {
+	var keys []string
+	for _, keyCtx := range ctx.AllOC_PropertyKeyName() {
+		keys = append(keys, analyzer.CanonicalName(keyCtx.GetText()))
+	}
+	return keys
+}
+
+// Returns the node of type T the expression consists of, if it is nothing more than that node
+func soleChild[T antlr.ParserRuleContext](expr antlr.ParserRuleContext) (T, bool) {
+	var zero T
+	for _, found := range findAll[T](expr) {
+		if found.GetStart() == expr.GetStart() && found.GetStop() == expr.GetStop() {
+			return found, true
+		}
+		return zero, false
+	}
+	return zero, false
+}
+
+// Returns all nodes of type T in the subtree
+func findAll[T antlr.Tree](tree antlr.Tree) []T {
+	var found []T
+	if t, ok := tree.(T); ok {
+		found = append(found, t)
+	}
+	for _, child := range tree.GetChildren() {
+		found = append(found, findAll[T](child)...)
+	}
+	return found
+}
+
+// Reports whether any ancestor of the node is of type T
+func within[T antlr.Tree](tree antlr.Tree) bool {
+	for parent := tree.GetParent(); parent != nil; parent = parent.GetParent() {
+		if _, ok := parent.(T); ok {
+			return true
+		}
+	}
+	return false
 }
 
-func (l *TreeListener) EnterOC_Set(ctx *parser.OC_SetContext) {
-	l.hasUpdate = true
+// Returns the name of a parameter, e.g. 'props' for $props
+func parameterName(ctx parser.IOC_ParameterContext) string {
+	return strings.Trim(strings.TrimPrefix(ctx.GetText(), "$"), "`")
 }
 
+// Records the procedures called by CALL clauses, both standalone and within a query
+func (l *TreeListener) EnterOC_ProcedureName(ctx *parser.OC_ProcedureNameContext) {
+	name := rewriter.QualifiedName(ctx.OC_Namespace(), ctx.OC_SymbolicName())
+	if l.procedures[name] == nil {
+		l.procedures[name] = analyzer.SpanOf(ctx)
+	}
+}
+
+// Records the namespaced functions the query invokes, e.g. apoc.text.join
+func (l *TreeListener) EnterOC_FunctionName(ctx *parser.OC_FunctionNameContext) {
+	if ctx.OC_Namespace().GetText() == "" {
+		return // built-in function
+	}
+	name := rewriter.QualifiedName(ctx.OC_Namespace(), ctx.OC_SymbolicName())
+	if l.functions[name] == nil {
+		l.functions[name] = analyzer.SpanOf(ctx)
+	}
+}
+
+// Records DELETE and DETACH DELETE as deleting whatever the deleted variables are bound to
 func (l *TreeListener) EnterOC_Delete(ctx *parser.OC_DeleteContext) {
-	l.hasDelete = true
+	if ctx.DETACH() != nil {
+		l.relOps.Add(analyzer.AnyRelationship, analyzer.OperationDelete, analyzer.SpanOf(ctx))
+	}
+	for _, exprCtx := range ctx.AllOC_Expression() {
+		for _, varCtx := range findAll[*parser.OC_VariableContext](exprCtx) {
+			l.varOps = append(l.varOps, variableOperation{Variable: varCtx.GetText(), Operation: analyzer.OperationDelete, Span: analyzer.SpanOf(exprCtx)})
+		}
+	}
 }
 
-func (p *ParserAnalyzer) analyzeQuery(cypher string, perm *postgres.Permissions) (*AnalysisResult, error) {
+func (p *ParserAnalyzer) analyzeQuery(cypher string, params map[string]any, perm *postgres.Permissions) (*AnalysisResult, error) {
 	log.Println("Analyzing the following query:", cypher)
 	listener := newTreeListener()
-	tree := parse(cypher)
+	tree, err := parse(cypher)
+	if err != nil {
+		log.Println("Parsing failed:", err)
+		return nil, err
+	}
 	antlr.ParseTreeWalkerDefault.Walk(listener, tree)
-	analysis := &AnalysisResult{Allowed: true, Violations: []string{}}
+	analysis := &AnalysisResult{Allowed: true, Violations: []analyzer.Violation{}}
 	initialViolations := len(analysis.Violations)
 
 	// Node Label check
@@ -130,9 +653,25 @@ func (p *ParserAnalyzer) analyzeQuery(cypher string, perm *postgres.Permissions)
 	}
 
 	for label := range listener.labelsFound {
-		if !allowedLabels[label] {
+		if rule, denied := perm.DeniedLabel(label); denied {
+			log.Printf("Label check failed: label '%s' is denied by rule '%s'", label, rule)
+			analysis.Violations = append(analysis.Violations, analyzer.Violation{
+				Kind:    analyzer.ViolationLabel,
+				Entity:  label,
+				Span:    listener.labelSpans[label],
+				RuleID:  fmt.Sprintf("denied_labels[%s]", rule),
+				Message: fmt.Sprintf("denied label '%s' (rule '%s')", label, rule),
+			})
+			analysis.Allowed = false
+		} else if !allowedLabels[label] {
 			log.Printf("Label check failed: label '%s' is not allowed", label)
-			analysis.Violations = append(analysis.Violations, fmt.Sprintf("disallowed label '%s'", label))
+			analysis.Violations = append(analysis.Violations, analyzer.Violation{
+				Kind:    analyzer.ViolationLabel,
+				Entity:  label,
+				Span:    listener.labelSpans[label],
+				RuleID:  "allowed_labels",
+				Message: fmt.Sprintf("disallowed label '%s'", label),
+			})
 			analysis.Allowed = false
 		}
 	}
@@ -151,9 +690,25 @@ func (p *ParserAnalyzer) analyzeQuery(cypher string, perm *postgres.Permissions)
 	}
 
 	for rel := range listener.relFound {
-		if !allowedRels[rel] {
+		if rule, denied := perm.DeniedRelationship(rel); denied {
+			log.Printf("Relationship check failed: relationship type '%s' is denied by rule '%s'", rel, rule)
+			analysis.Violations = append(analysis.Violations, analyzer.Violation{
+				Kind:    analyzer.ViolationRelationship,
+				Entity:  rel,
+				Span:    listener.relSpans[rel],
+				RuleID:  fmt.Sprintf("denied_relationships[%s]", rule),
+				Message: fmt.Sprintf("denied relationship type '%s' (rule '%s')", rel, rule),
+			})
+			analysis.Allowed = false
+		} else if !allowedRels[rel] {
 			log.Printf("Relationship check failed: relationship type '%s' is not allowed", rel)
-			analysis.Violations = append(analysis.Violations, fmt.Sprintf("disallowed relationship type '%s'", rel))
+			analysis.Violations = append(analysis.Violations, analyzer.Violation{
+				Kind:    analyzer.ViolationRelationship,
+				Entity:  rel,
+				Span:    listener.relSpans[rel],
+				RuleID:  "allowed_relationships",
+				Message: fmt.Sprintf("disallowed relationship type '%s'", rel),
+			})
 			analysis.Allowed = false
 		}
 	}
@@ -165,19 +720,91 @@ func (p *ParserAnalyzer) analyzeQuery(cypher string, perm *postgres.Permissions)
 	}
 
 	// Property check
+	// Lookups on a variable must be allowed on every label or relationship type it may be bound to
 	initialViolations = len(analysis.Violations)
+	effectiveLabels, effectiveRels := perm.EffectiveLabels(), perm.EffectiveRelationships()
 	allowedProps := make(map[string]bool)
-	for _, props := range perm.AllowedProperties {
+	entityProps := make(map[string]map[string]bool, len(perm.AllowedProperties))
+	for entity, props := range perm.AllowedProperties {
+		entity = strings.ToLower(entity)
+		if entityProps[entity] == nil {
+			entityProps[entity] = make(map[string]bool, len(props))
+		}
 		for _, prop := range props {
 			allowedProps[strings.ToLower(prop)] = true
+			entityProps[entity][strings.ToLower(prop)] = true
 		}
 	}
 
-	for prop := range listener.propsFound {
-		if !allowedProps[prop] {
-			log.Printf("Property check failed: property '%s' is not allowed", prop)
-			analysis.Violations = append(analysis.Violations, fmt.Sprintf("disallowed property '%s'", prop))
-			analysis.Allowed = false
+	for access := range listener.propsFound {
+		prop := access.Property
+		var labels, relTypes map[string]bool
+		if !access.Value {
+			labels, relTypes = listener.entities(access.Variable)
+			labels = analyzer.ExpandAny(labels, analyzer.AnyLabel, effectiveLabels)
+			relTypes = analyzer.ExpandAny(relTypes, analyzer.AnyRelationship, effectiveRels)
+		}
+
+		suffix := ""
+		if access.Variable != "" {
+			suffix = fmt.Sprintf(" (variable '%s')", access.Variable)
+		}
+		violation := analyzer.Violation{
+			Kind:     analyzer.ViolationProperty,
+			Property: prop,
+			Variable: access.Variable,
+			Span:     listener.propSpans[access],
+		}
+
+		if len(labels) == 0 && len(relTypes) == 0 {
+			if rule, denied := perm.DeniedProperty("", prop); denied {
+				log.Printf("Property check failed: property '%s' is denied by rule '%s'", prop, rule)
+				violation.RuleID = fmt.Sprintf("denied_properties[%s]", rule)
+				violation.Message = fmt.Sprintf("disallowed property '%s' denied by rule '%s'%s", prop, rule, suffix)
+				analysis.Violations = append(analysis.Violations, violation)
+				analysis.Allowed = false
+			} else if !allowedProps[prop] {
+				log.Printf("Property check failed: property '%s' is not allowed", prop)
+				violation.RuleID = "allowed_properties"
+				violation.Message = fmt.Sprintf("disallowed property '%s'%s", prop, suffix)
+				analysis.Violations = append(analysis.Violations, violation)
+				analysis.Allowed = false
+			}
+			continue
+		}
+
+		for label := range labels {
+			violation.Entity = label
+			if rule, denied := perm.DeniedProperty(label, prop); denied {
+				log.Printf("Property check failed: property '%s' on label '%s' is denied by rule '%s'", prop, label, rule)
+				violation.RuleID = fmt.Sprintf("denied_properties[%s]", rule)
+				violation.Message = fmt.Sprintf("disallowed property '%s' on label '%s' denied by rule '%s'%s", prop, label, rule, suffix)
+				analysis.Violations = append(analysis.Violations, violation)
+				analysis.Allowed = false
+			} else if !entityProps[label][prop] {
+				log.Printf("Property check failed: property '%s' is not allowed on label '%s'", prop, label)
+				violation.RuleID = fmt.Sprintf("allowed_properties[%s]", label)
+				violation.Message = fmt.Sprintf("disallowed property '%s' on label '%s'%s", prop, label, suffix)
+				analysis.Violations = append(analysis.Violations, violation)
+				analysis.Allowed = false
+			}
+		}
+
+		for relType := range relTypes {
+			violation.Entity = relType
+			if rule, denied := perm.DeniedProperty(relType, prop); denied {
+				log.Printf("Property check failed: property '%s' on relationship type '%s' is denied by rule '%s'", prop, relType, rule)
+				violation.RuleID = fmt.Sprintf("denied_properties[%s]", rule)
+				violation.Message = fmt.Sprintf("disallowed property '%s' on relationship type '%s' denied by rule '%s'%s", prop, relType, rule, suffix)
+				analysis.Violations = append(analysis.Violations, violation)
+				analysis.Allowed = false
+			} else if !entityProps[relType][prop] {
+				log.Printf("Property check failed: property '%s' is not allowed on relationship type '%s'", prop, relType)
+				violation.RuleID = fmt.Sprintf("allowed_properties[%s]", relType)
+				violation.Message = fmt.Sprintf("disallowed property '%s' on relationship type '%s'%s", prop, relType, suffix)
+				analysis.Violations = append(analysis.Violations, violation)
+				analysis.Allowed = false
+			}
 		}
 	}
 
@@ -187,155 +814,239 @@ func (p *ParserAnalyzer) analyzeQuery(cypher string, perm *postgres.Permissions)
 		log.Printf("Property check completed with violations. Allowed properties: %+v\n", allowedProps)
 	}
 
-	// Operation check
+	// Dynamic property access check
+	// properties(n), keys(n) and n[key] read properties without a lookup, so only literal keys can be checked
 	initialViolations = len(analysis.Violations)
-	operation := "read" // default for MATCH queries
-	if listener.hasCreate {
-		operation = "create"
-	} else if listener.hasUpdate {
-		operation = "update"
-	} else if listener.hasDelete {
-		operation = "delete"
+	for _, access := range rewriter.FindDynamicAccesses(tree) {
+		// Subscripts of lists and maps read no properties
+		if _, isCall := access.Expr.(*parser.OC_FunctionInvocationContext); !isCall && listener.plainValue(access.Variable) {
+			continue
+		}
+		span := analyzer.SpanOf(access.Expr)
+		if access.Computed {
+			log.Printf("Dynamic property access check failed: '%s' reads properties that cannot be determined", access.Form)
+			analysis.Violations = append(analysis.Violations, analyzer.Violation{
+				Kind:     analyzer.ViolationDynamic,
+				Variable: access.Variable,
+				Span:     span,
+				RuleID:   "allowed_properties",
+				Message:  fmt.Sprintf("the properties read by '%s' cannot be determined", access.Form),
+			})
+			analysis.Allowed = false
+			continue
+		}
+
+		labels, relTypes := listener.entities(access.Variable)
+		entities := analyzer.ExpandAny(labels, analyzer.AnyLabel, effectiveLabels)
+		maps.Copy(entities, analyzer.ExpandAny(relTypes, analyzer.AnyRelationship, effectiveRels))
+		violations := analyzer.CheckKeyedProperties(perm, []string{access.Key}, fmt.Sprintf("dynamic access %s", access.Form), slices.Sorted(maps.Keys(entities)), span, false)
+		for i := range violations {
+			violations[i].Kind, violations[i].Variable = analyzer.ViolationDynamic, access.Variable
+		}
+		if len(violations) > 0 {
+			analysis.Violations = append(analysis.Violations, violations...)
+			analysis.Allowed = false
+		}
 	}
 
-	// Normalize the operation permissions keys
-	opPerms := make(map[string]postgres.OperationPermissions, len(perm.OperationPermissions))
-	for k, v := range perm.OperationPermissions {
-		opPerms[strings.ToLower(k)] = v
+	if len(analysis.Violations) == initialViolations {
+		log.Println("Dynamic property access check passed")
+	} else {
+		log.Println("Dynamic property access check completed with violations")
 	}
 
-	for label := range listener.labelsFound {
-		if perms, ok := opPerms[label]; ok {
-			log.Printf("For label '%s': operation '%s', permission read=%v\n", label, operation, perms.Read)
-			var allowed bool
-			switch operation {
-			case "read":
-				allowed = perms.Read
-			case "create":
-				allowed = perms.Create
-			case "update":
-				allowed = perms.Update
-			case "delete":
-				allowed = perms.Delete
-			}
-			if !allowed {
-				log.Printf("Operation check failed for label '%s' for operation '%s'\n", label, operation)
-				analysis.Violations = append(analysis.Violations, fmt.Sprintf("operation '%s' is not allowed on label '%s'", operation, label))
-				analysis.Allowed = false
+	// Keyed property check
+	initialViolations = len(analysis.Violations)
+	for _, kp := range listener.keyedProps {
+		labels, relTypes := make(map[string]bool), make(map[string]bool)
+		if kp.Variable != "" {
+			labels, relTypes = listener.entities(kp.Variable)
+		}
+		maps.Copy(labels, kp.Entities)
+		entities := analyzer.ExpandAny(labels, analyzer.AnyLabel, effectiveLabels)
+		maps.Copy(entities, analyzer.ExpandAny(relTypes, analyzer.AnyRelationship, effectiveRels))
+
+		if kp.Unknown {
+			log.Printf("Write check failed: the properties written to '%s' cannot be determined", kp.Variable)
+			analysis.Violations = append(analysis.Violations, analyzer.Violation{
+				Kind:     analyzer.ViolationWrite,
+				Variable: kp.Variable,
+				Span:     kp.Span,
+				RuleID:   "allowed_write_properties",
+				Message:  fmt.Sprintf("the properties written to '%s' in %s cannot be determined", kp.Variable, kp.Source),
+			})
+			analysis.Allowed = false
+			continue
+		}
+
+		keys := kp.Keys
+		if kp.Parameter != "" {
+			var ok bool
+			if keys, ok = analyzer.ParameterKeys(params[kp.Parameter]); !ok {
+				continue
 			}
 		}
+
+		var violations []analyzer.Violation
+		sorted := slices.Sorted(maps.Keys(entities))
+		if kp.Read {
+			violations = append(violations, analyzer.CheckKeyedProperties(perm, keys, kp.Source, sorted, kp.Span, false)...)
+		}
+		if kp.Write {
+			violations = append(violations, analyzer.CheckKeyedProperties(perm, keys, kp.Source, sorted, kp.Span, true)...)
+		}
+		for i := range violations {
+			violations[i].Variable = kp.Variable
+		}
+		if len(violations) > 0 {
+			analysis.Violations = append(analysis.Violations, violations...)
+			analysis.Allowed = false
+		}
 	}
 
 	if len(analysis.Violations) == initialViolations {
-		log.Printf("Operation check passed. Operation: %s\n", operation)
+		log.Println("Keyed property check passed")
 	} else {
-		log.Printf("Operation check completed with violations. Operation: %s\n", operation)
+		log.Println("Keyed property check completed with violations")
 	}
 
-	log.Println("Analysis complete with violations:", analysis.Violations)
-	return analysis, nil
-}
-
-func (p *ParserAnalyzer) rewriteQuery(cypher string, analysis *AnalysisResult) (string, bool, error) {
-	log.Println("Attempting to rewrite the query. Violations:", analysis.Violations)
-
-	// Determine if there are any violations other than disallowed properties
-	nonPropertyViolations := false
-	var disallowedProps []string
-	for _, v := range analysis.Violations {
-		if !strings.HasPrefix(v, "disallowed property") {
-			nonPropertyViolations = true
-			break
+	// Operation check
+	initialViolations = len(analysis.Violations)
+	for _, op := range listener.varOps {
+		labels, relTypes := listener.entities(op.Variable)
+		for label := range labels {
+			listener.labelOps.Add(label, op.Operation, op.Span)
 		}
-		parts := strings.Split(v, "'")
-		if len(parts) >= 2 {
-			disallowedProps = append(disallowedProps, parts[1])
+		for relType := range relTypes {
+			listener.relOps.Add(relType, op.Operation, op.Span)
 		}
 	}
 
-	if nonPropertyViolations {
-		log.Println("Rewriting not possible due to violations other than disallowed properties")
-		return "", false, fmt.Errorf("Cannot safely rewrite the query")
+	if violations := analyzer.CheckOperations(perm, listener.labelOps, listener.relOps); len(violations) > 0 {
+		analysis.Violations = append(analysis.Violations, violations...)
+		analysis.Allowed = false
 	}
 
-	// Extract the RETURN clause from the query
-	// This assumes the RETURN clause is at the end of the query
-	retRegex, err := regexp.Compile(`(?i)return\s+(.+)$`)
-	if err != nil {
-		return "", false, fmt.Errorf("%s", err.Error())
+	if len(analysis.Violations) == initialViolations {
+		log.Printf("Operation check passed. Labels: %v. Relationship types: %v\n", listener.labelOps, listener.relOps)
+	} else {
+		log.Printf("Operation check completed with violations. Labels: %v. Relationship types: %v\n", listener.labelOps, listener.relOps)
 	}
 
-	matches := retRegex.FindStringSubmatch(cypher)
-	if len(matches) < 2 {
-		log.Println("Rewriting fails due to no RETURN clause being found")
-		return "", false, fmt.Errorf("Cannot safely rewrite the query")
+	// Procedure and function check
+	initialViolations = len(analysis.Violations)
+	for _, name := range slices.Sorted(maps.Keys(listener.procedures)) {
+		if _, ok := perm.AllowedProcedure(name); !ok {
+			log.Printf("Procedure check failed: procedure '%s' is not allowed", name)
+			analysis.Violations = append(analysis.Violations, analyzer.Violation{
+				Kind:    analyzer.ViolationProcedure,
+				Entity:  name,
+				Span:    listener.procedures[name],
+				RuleID:  "allowed_procedures",
+				Message: fmt.Sprintf("disallowed procedure '%s'", name),
+			})
+			analysis.Allowed = false
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(listener.functions)) {
+		if _, ok := perm.AllowedFunction(name); !ok {
+			log.Printf("Function check failed: function '%s' is not allowed", name)
+			analysis.Violations = append(analysis.Violations, analyzer.Violation{
+				Kind:    analyzer.ViolationFunction,
+				Entity:  name,
+				Span:    listener.functions[name],
+				RuleID:  "allowed_functions",
+				Message: fmt.Sprintf("disallowed function '%s'", name),
+			})
+			analysis.Allowed = false
+		}
 	}
 
-	originalReturnClause := matches[1]
+	if len(analysis.Violations) == initialViolations {
+		log.Println("Procedure and function check passed")
+	} else {
+		log.Println("Procedure and function check completed with violations")
+	}
 
-	// Split the RETURN clause into individual fields
-	fields := strings.Split(originalReturnClause, ",")
-	var allowedFields []string
-	for _, field := range fields {
-		trimmed := strings.TrimSpace(field)
-		skip := false
+	props := make(map[string]bool, len(listener.propsFound))
+	for access := range listener.propsFound {
+		props[access.Property] = true
+	}
+	analysis.Entities = analyzer.NewEntities(listener.labelsFound, listener.relFound, props)
 
-		// Skip fields that reference any disallowed property
-		for _, prop := range disallowedProps {
-			if strings.Contains(strings.ToLower(trimmed), "."+strings.ToLower(prop)) {
-				log.Printf("Removing field '%s' due to disallowed property '%s'\n", trimmed, prop)
-				skip = true
-				break
-			}
-		}
-		if !skip {
-			allowedFields = append(allowedFields, trimmed)
-		}
+	log.Println("Analysis complete with violations:", analysis.Violations)
+	return analysis, nil
+}
+
+// Constrains unlabelled nodes and untyped relationships to the effective labels and types, and applies row filters
+func (p *ParserAnalyzer) constrainQuery(cypher string, perm *postgres.Permissions) (string, []analyzer.Violation, error) {
+	rw, err := rewriter.New(cypher)
+	if err != nil {
+		return "", nil, err
 	}
 
-	if len(allowedFields) == 0 {
-		log.Println("Rewriting fails due to resulting in an empty RETURN clause")
-		return "", false, fmt.Errorf("Cannot safely rewrite the query")
+	constraints := rw.ConstrainPatterns(perm.EffectiveLabels(), perm.EffectiveRelationships(), perm.DeniedLabels)
+
+	filters, err := rw.ApplyRowFilters(perm.RowFilters, perm.RelationshipRowFilters)
+	if err != nil {
+		return "", nil, err
 	}
+	constraints = append(constraints, filters...)
 
-	// Rebuild the new RETURN clause
-	newReturnClause := "RETURN " + strings.Join(allowedFields, ", ")
+	if len(constraints) == 0 {
+		return cypher, nil, nil
+	}
 
-	// Replace the original RETURN clause with the new one
-	rewrittenQuery := retRegex.ReplaceAllString(cypher, newReturnClause)
-	log.Println("Rewriting succeeded. New query:", rewrittenQuery)
-	return rewrittenQuery, true, nil // 'true' indicates a rewritten query was returned
+	constrainedQuery := rw.Text()
+	log.Println("Constrained patterns. New query:", constrainedQuery)
+	return constrainedQuery, constraints, nil
 }
 
-func (p *ParserAnalyzer) AnalyzeAndExecute(cypher string, perm *postgres.Permissions) ([]map[string]any, bool, string, []string, error) {
-	log.Println("Analyzing with Parser Analyzer...")
-	analysis, err := p.analyzeQuery(cypher, perm)
+func (p *ParserAnalyzer) Analyze(ctx context.Context, cypher string, params map[string]any, principal *analyzer.Principal) (*analyzer.Decision, error) {
+	decision := &analyzer.Decision{Status: analyzer.DecisionAllowed, Query: cypher, Parameters: params}
+	decision.Tracef("Analyzing with Parser Analyzer...")
+	perm := principal.Permissions
+	analysis, err := p.analyzeQuery(cypher, params, perm)
 	if err != nil {
-		return nil, false, "", nil, err
+		return nil, err
 	}
+	decision.Violations, decision.Entities = analysis.Violations, analysis.Entities
 
-	// Execute the query if it passed analysis
-	if analysis.Allowed {
-		log.Println("Query deemed safe. Executing original query...")
-		results, err := graphdb.QueryHandler(p.Ctx, p.Driver, cypher)
+	// Attempt to rewrite the query if it did not pass analysis
+	if !analysis.Allowed {
+		decision.Tracef("Query is unsafe. Attempting to rewrite...")
+		rewrittenQuery, rewritten, err := rewriter.RewriteQuery(cypher, analysis.Violations, perm.Strictness)
 		if err != nil {
-			return nil, false, "", analysis.Violations, err
+			decision.Tracef("Rewriting failed: %s", err)
+			return decision.Block(), nil
+		}
+		if rewritten {
+			decision.Status, decision.Query = analyzer.DecisionRewritten, rewrittenQuery
+			decision.Tracef("Removed disallowed properties: %s", rewrittenQuery)
+		} else {
+			// The violations did not apply to the query, so an allowed decision does not report them
+			decision.Violations = nil
 		}
-		return results, false, "", analysis.Violations, nil
 	}
 
-	// Otherwise attempt to rewrite the query
-	log.Println("Query is unsafe. Attempting to rewrite...")
-	rewritten, wasRewritten, err := p.rewriteQuery(cypher, analysis)
+	constrained, constraints, err := p.constrainQuery(decision.Query, perm)
 	if err != nil {
-		return nil, wasRewritten, rewritten, analysis.Violations, analyzer.ForbiddenQueryErr
+		decision.Tracef("Constraining failed: %s", err)
+		decision.Violations = append(decision.Violations, analyzer.Violation{Kind: analyzer.ViolationRowFilter, RuleID: "row_filters", Message: err.Error()})
+		return decision.Block(), nil
+	}
+	if len(constraints) > 0 {
+		decision.Status, decision.Query = analyzer.DecisionRewritten, constrained
+		decision.Violations = append(decision.Violations, constraints...)
+		decision.Tracef("Constrained patterns and applied row filters: %s", constrained)
 	}
 
-	log.Println("Rewritten query accepted. Executing rewritten query...")
-	results, err := graphdb.QueryHandler(p.Ctx, p.Driver, rewritten)
-	if err != nil {
-		return nil, wasRewritten, rewritten, analysis.Violations, err
+	// Rewritten queries may reference the user's attributes in row filters
+	if decision.Status == analyzer.DecisionRewritten {
+		decision.Parameters = analyzer.RewriteParameters(params, principal.Attributes)
+	} else {
+		decision.Tracef("Query deemed safe")
 	}
 
-	return results, wasRewritten, rewritten, analysis.Violations, nil
+	return decision, nil
 }
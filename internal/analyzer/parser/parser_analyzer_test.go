@@ -0,0 +1,406 @@
+package parser
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"testing"
+
+	"github.com/danielbahrami/se10-mt/internal/analyzer"
+	"github.com/danielbahrami/se10-mt/internal/analyzer/analyzertest"
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+func TestAnalyze(t *testing.T) {
+	tests := []struct {
+		name   string
+		query  string
+		params map[string]any
+		status analyzer.DecisionStatus
+		want   string
+	}{
+		{
+			name:   "allowed property",
+			query:  "MATCH (p:Patient) RETURN p.name",
+			status: analyzer.DecisionAllowed,
+			want:   "MATCH (p:Patient) RETURN p.name",
+		},
+		{
+			name:   "disallowed property removed",
+			query:  "MATCH (p:Patient) RETURN p.name, p.ssn",
+			status: analyzer.DecisionRewritten,
+			want:   "MATCH (p:Patient) RETURN p.name",
+		},
+		{
+			name:   "disallowed label",
+			query:  "MATCH (d:Doctor) RETURN d.name",
+			status: analyzer.DecisionBlocked,
+		},
+		{
+			name:   "property allowed on another label",
+			query:  "MATCH (e:Employee) RETURN e.age",
+			status: analyzer.DecisionBlocked,
+		},
+
+		// Aliases
+		{
+			name:   "allowed property through alias",
+			query:  "MATCH (p:Patient) WITH p AS q RETURN q.name",
+			status: analyzer.DecisionAllowed,
+			want:   "MATCH (p:Patient) WITH p AS q RETURN q.name",
+		},
+		{
+			name:   "disallowed property through alias removed",
+			query:  "MATCH (p:Patient) WITH p AS q RETURN q.name, q.ssn",
+			status: analyzer.DecisionRewritten,
+			want:   "MATCH (p:Patient) WITH p AS q RETURN q.name",
+		},
+		{
+			name:   "disallowed property through alias",
+			query:  "MATCH (p:Patient) WITH p AS q RETURN q.ssn",
+			status: analyzer.DecisionBlocked,
+		},
+		{
+			name:   "disallowed property through unwound list",
+			query:  "MATCH (p:Patient) WITH collect(p) AS ps UNWIND ps AS q RETURN q.ssn",
+			status: analyzer.DecisionBlocked,
+		},
+
+		// Comprehensions
+		{
+			name:   "disallowed property in list comprehension",
+			query:  "MATCH (p:Patient) RETURN [x IN [p] | x.ssn]",
+			status: analyzer.DecisionBlocked,
+		},
+		{
+			name:   "disallowed property in list comprehension predicate",
+			query:  "MATCH (p:Patient) RETURN [x IN [p] WHERE x.ssn = '1' | x.name]",
+			status: analyzer.DecisionBlocked,
+		},
+		{
+			name:   "disallowed property in quantifier",
+			query:  "MATCH (p:Patient) RETURN any(x IN [p] WHERE x.ssn = '1')",
+			status: analyzer.DecisionBlocked,
+		},
+
+		// Properties used outside of RETURN
+		{
+			name:   "disallowed property in WHERE neutralized",
+			query:  "MATCH (p:Patient) WHERE p.ssn = '1' RETURN p.name",
+			status: analyzer.DecisionRewritten,
+			want:   "MATCH (p:Patient) WHERE null = '1' RETURN p.name",
+		},
+		{
+			name:   "disallowed property written",
+			query:  "MATCH (e:Employee) SET e.ssn = '1' RETURN e.name",
+			status: analyzer.DecisionBlocked,
+		},
+		{
+			name:   "disallowed property written from",
+			query:  "MATCH (e:Employee) SET e.name = e.ssn RETURN e.name",
+			status: analyzer.DecisionBlocked,
+		},
+
+		// Unlabelled nodes and untyped relationships
+		{
+			name:   "unlabelled node constrained",
+			query:  "MATCH (n) RETURN n.name",
+			status: analyzer.DecisionRewritten,
+			want:   "MATCH (n) WHERE (n:Patient OR n:Employee) AND NOT any(_l0 IN labels(n) WHERE toLower(_l0) = 'secret') RETURN n.name",
+		},
+		{
+			name:   "untyped relationship constrained",
+			query:  "MATCH (e:Employee)-[r]->(p:Patient) RETURN p.name",
+			status: analyzer.DecisionRewritten,
+			want:   "MATCH (e:Employee)-[r]->(p:Patient) WHERE type(r) IN ['TREATS'] RETURN p.name",
+		},
+		{
+			name:   "disallowed property in pattern comprehension",
+			query:  "MATCH (e:Employee) RETURN [(e)-[:TREATS]->(p:Patient) | p.ssn]",
+			status: analyzer.DecisionBlocked,
+		},
+		{
+			name:   "unlabelled node in pattern comprehension constrained",
+			query:  "MATCH (e:Employee) RETURN [(e)-[:TREATS]->(s) | s.name]",
+			status: analyzer.DecisionRewritten,
+			want:   "MATCH (e:Employee) RETURN [(e)-[:TREATS]->(s) WHERE (e:Patient OR e:Employee) AND NOT any(_l0 IN labels(e) WHERE toLower(_l0) = 'secret') AND (s:Patient OR s:Employee) AND NOT any(_l1 IN labels(s) WHERE toLower(_l1) = 'secret') | s.name]",
+		},
+		{
+			name:   "unlabelled node in pattern predicate constrained",
+			query:  "MATCH (e:Employee) WHERE (e)-[:TREATS]->() RETURN e.name",
+			status: analyzer.DecisionRewritten,
+			want:   "MATCH (e:Employee) WHERE EXISTS { (e)-[:TREATS]->(_n0) WHERE (e:Patient OR e:Employee) AND NOT any(_l0 IN labels(e) WHERE toLower(_l0) = 'secret') AND (_n0:Patient OR _n0:Employee) AND NOT any(_l1 IN labels(_n0) WHERE toLower(_l1) = 'secret') } RETURN e.name",
+		},
+
+		// Denied labels
+		{
+			name:   "denied label",
+			query:  "MATCH (s:Secret) RETURN s",
+			status: analyzer.DecisionBlocked,
+		},
+		{
+			name:   "denied label in predicate",
+			query:  "MATCH (p:Patient) WHERE p:Secret RETURN p.name",
+			status: analyzer.DecisionBlocked,
+		},
+		{
+			name:   "denied label next to an allowed label",
+			query:  "MATCH (p:Patient:Secret) RETURN p.name",
+			status: analyzer.DecisionBlocked,
+		},
+		{
+			name:   "disallowed type next to an allowed type",
+			query:  "MATCH (e:Employee)-[r:TREATS|OWNS]->(p:Patient) RETURN p.name",
+			status: analyzer.DecisionBlocked,
+		},
+		{
+			name:   "create of denied label",
+			query:  "CREATE (s:Secret)",
+			status: analyzer.DecisionBlocked,
+		},
+		{
+			name:   "denied label in pattern comprehension",
+			query:  "MATCH (e:Employee) RETURN [(e)-[:TREATS]->(s:Secret) | s.name]",
+			status: analyzer.DecisionBlocked,
+		},
+		{
+			name:   "denied label in pattern predicate",
+			query:  "MATCH (e:Employee) WHERE (e)-[:TREATS]->(:Secret) RETURN e.name",
+			status: analyzer.DecisionBlocked,
+		},
+
+		// Parameters
+		{
+			name:   "allowed parameter map",
+			query:  "MATCH (p:Patient $props) RETURN p.name",
+			params: map[string]any{"props": map[string]any{"name": "x"}},
+			status: analyzer.DecisionAllowed,
+			want:   "MATCH (p:Patient $props) RETURN p.name",
+		},
+		{
+			name:   "disallowed parameter map",
+			query:  "MATCH (p:Patient $props) RETURN p.name",
+			params: map[string]any{"props": map[string]any{"ssn": "1"}},
+			status: analyzer.DecisionBlocked,
+		},
+
+		// Written properties
+		{
+			name:   "write of allowed property in map",
+			query:  "MATCH (e:Employee) SET e += {name: 'x'}",
+			status: analyzer.DecisionAllowed,
+			want:   "MATCH (e:Employee) SET e += {name: 'x'}",
+		},
+		{
+			name:   "write of disallowed property in map",
+			query:  "MATCH (e:Employee) SET e += {name: 'x', ssn: '1'}",
+			status: analyzer.DecisionBlocked,
+		},
+
+		// Operations
+		{
+			name:   "write without update permission",
+			query:  "MATCH (p:Patient) SET p.name = 'x'",
+			status: analyzer.DecisionBlocked,
+		},
+		{
+			name:   "write with update permission",
+			query:  "MATCH (e:Employee) SET e.name = 'x'",
+			status: analyzer.DecisionAllowed,
+			want:   "MATCH (e:Employee) SET e.name = 'x'",
+		},
+		{
+			name:   "write of one label and read of another",
+			query:  "MATCH (p:Patient), (e:Employee) SET e.name = p.name",
+			status: analyzer.DecisionAllowed,
+			want:   "MATCH (p:Patient), (e:Employee) SET e.name = p.name",
+		},
+		{
+			name:   "remove without update permission",
+			query:  "MATCH (p:Patient) REMOVE p.name",
+			status: analyzer.DecisionBlocked,
+		},
+		{
+			name:   "merge without create permission",
+			query:  "MERGE (p:Patient {name: 'x'})",
+			status: analyzer.DecisionBlocked,
+		},
+		{
+			name:   "detach delete without delete permission",
+			query:  "MATCH (e:Employee) DETACH DELETE e",
+			status: analyzer.DecisionBlocked,
+		},
+		{
+			name:   "write through unlabelled variable",
+			query:  "MATCH (n) SET n.name = 'x'",
+			status: analyzer.DecisionBlocked,
+		},
+		{
+			name:   "write through alias",
+			query:  "MATCH (p:Patient) WITH p AS q SET q.name = 'x'",
+			status: analyzer.DecisionBlocked,
+		},
+		{
+			name:   "label added through alias",
+			query:  "MATCH (p:Patient) WITH p AS q SET q:Employee",
+			status: analyzer.DecisionBlocked,
+		},
+
+		// Relationship operations
+		{
+			name:   "create of relationship without create permission",
+			query:  "MATCH (e:Employee), (p:Patient) CREATE (e)-[:TREATS]->(p)",
+			status: analyzer.DecisionBlocked,
+		},
+		{
+			name:   "delete of untyped relationship",
+			query:  "MATCH (p:Patient)-[r]->() DELETE r",
+			status: analyzer.DecisionBlocked,
+		},
+
+		// Procedures and functions
+		{
+			name:   "allowed procedure",
+			query:  "CALL db.labels()",
+			status: analyzer.DecisionAllowed,
+			want:   "CALL db.labels()",
+		},
+		{
+			name:   "allowed procedure quoted",
+			query:  "CALL `db`.`labels`()",
+			status: analyzer.DecisionAllowed,
+			want:   "CALL `db`.`labels`()",
+		},
+		{
+			name:   "disallowed procedure",
+			query:  "CALL dbms.listConfig()",
+			status: analyzer.DecisionBlocked,
+		},
+		{
+			name:   "disallowed namespaced function",
+			query:  "MATCH (p:Patient) RETURN apoc.text.join([p.name], ',')",
+			status: analyzer.DecisionBlocked,
+		},
+
+		// Dynamic property access
+		{
+			name:   "properties of node neutralized",
+			query:  "MATCH (p:Patient) RETURN p.name, properties(p)",
+			status: analyzer.DecisionRewritten,
+			want:   "MATCH (p:Patient) RETURN p.name, null AS `properties(p)`",
+		},
+		{
+			name:   "quoted properties function",
+			query:  "MATCH (p:Patient) RETURN p.name, `properties`(p)",
+			status: analyzer.DecisionRewritten,
+			want:   "MATCH (p:Patient) RETURN p.name, null AS ```properties``(p)`",
+		},
+		{
+			name:   "allowed literal key",
+			query:  "MATCH (p:Patient) RETURN p['name']",
+			status: analyzer.DecisionAllowed,
+			want:   "MATCH (p:Patient) RETURN p['name']",
+		},
+		{
+			name:   "disallowed literal key",
+			query:  "MATCH (p:Patient) RETURN p['ssn']",
+			status: analyzer.DecisionRewritten,
+			want:   "MATCH (p:Patient) RETURN null AS `p['ssn']`",
+		},
+		{
+			name:   "computed key in WHERE",
+			query:  "MATCH (p:Patient) WHERE p[$key] = '1' RETURN p.name",
+			status: analyzer.DecisionRewritten,
+			want:   "MATCH (p:Patient) WHERE null = '1' RETURN p.name",
+		},
+		{
+			name:   "computed index of list",
+			query:  "WITH [1, 2, 3] AS l UNWIND [0, 1] AS i RETURN l[i]",
+			status: analyzer.DecisionAllowed,
+			want:   "WITH [1, 2, 3] AS l UNWIND [0, 1] AS i RETURN l[i]",
+		},
+		{
+			name:   "computed key of map",
+			query:  "MATCH (p:Patient) WITH p, {a: 1} AS m RETURN p.name, m[$key]",
+			status: analyzer.DecisionAllowed,
+			want:   "MATCH (p:Patient) WITH p, {a: 1} AS m RETURN p.name, m[$key]",
+		},
+		{
+			name:   "computed key of alias",
+			query:  "MATCH (p:Patient) WITH p AS q RETURN q[$key]",
+			status: analyzer.DecisionRewritten,
+			want:   "MATCH (p:Patient) WITH p AS q RETURN null AS `q[$key]`",
+		},
+		{
+			name:   "literal list holding a variable",
+			query:  "MATCH (p:Patient) RETURN [p][0]['ssn']",
+			status: analyzer.DecisionRewritten,
+			want:   "MATCH (p:Patient) RETURN null AS `[p][0]['ssn']`",
+		},
+		{
+			name:   "literal map holding a variable",
+			query:  "MATCH (p:Patient) RETURN {a: p}['a']['ssn']",
+			status: analyzer.DecisionRewritten,
+			want:   "MATCH (p:Patient) RETURN null AS `{a: p}['a']['ssn']`",
+		},
+
+		// Escaped names and comments
+		{
+			name:   "quoted denied label",
+			query:  "MATCH (s:`Secret`) RETURN s",
+			status: analyzer.DecisionBlocked,
+		},
+		{
+			name:   "denied label after comment",
+			query:  "MATCH (s:/* label */Secret) RETURN s",
+			status: analyzer.DecisionBlocked,
+		},
+		{
+			name:   "escaped denied label",
+			query:  "MATCH (s:`Sec\\u0072et`) RETURN s",
+			status: analyzer.DecisionBlocked,
+		},
+	}
+
+	p := New(nil)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			decision, err := p.Analyze(context.Background(), tt.query, tt.params, &analyzer.Principal{Permissions: analyzertest.Permissions()})
+			if err != nil {
+				t.Fatalf("Analyze(%q) failed: %v", tt.query, err)
+			}
+			if decision.Status != tt.status {
+				t.Errorf("Analyze(%q) status = %s, want %s", tt.query, decision.Status, tt.status)
+			}
+			if decision.Query != tt.want {
+				t.Errorf("Analyze(%q) query = %q, want %q", tt.query, decision.Query, tt.want)
+			}
+			if decision.Status == analyzer.DecisionAllowed && len(decision.Violations) > 0 {
+				t.Errorf("Analyze(%q) is allowed with violations %v", tt.query, decision.Violations)
+			}
+		})
+	}
+}
+
+func TestAnalyzeSyntaxError(t *testing.T) {
+	queries := []string{
+		"MATCH (p:Patient RETURN p.name",
+		"MATCH (p:Patient) RETURN p.name; MATCH (s:Secret) RETURN s",
+		"MATCH (p:Patient) RETURN p.name )",
+	}
+
+	p := New(nil)
+	for _, query := range queries {
+		_, err := p.Analyze(context.Background(), query, nil, &analyzer.Principal{Permissions: analyzertest.Permissions()})
+		var syntaxErr *analyzer.SyntaxError
+		if !errors.As(err, &syntaxErr) {
+			t.Errorf("Analyze(%q) error = %v, want a syntax error", query, err)
+		}
+	}
+}
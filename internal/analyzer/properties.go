@@ -0,0 +1,82 @@
+package analyzer
+
+import (
+	"fmt"
+	"log"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/danielbahrami/se10-mt/internal/postgres"
+)
+
+// Returns the keys of a parameter value, or false if it is not a map
+// Values that are not maps are left to Neo4j, which rejects them where a map is expected
+func ParameterKeys(value any) ([]string, bool) {
+	props, ok := value.(map[string]any)
+	if !ok {
+		return nil, false
+	}
+	return slices.Sorted(maps.Keys(props)), true
+}
+
+// Checks keys that are matched or written, e.g. of CREATE (n:Employee {name: 'x'}), against the grants of each entity
+func CheckKeyedProperties(perm *postgres.Permissions, keys []string, source string, entities []string, span *Span, write bool) []Violation {
+	grants, kind, verb, ruleID := perm.AllowedProperties, ViolationMapKey, "property", "allowed_properties"
+	if write {
+		grants, kind, verb, ruleID = perm.WriteProperties(), ViolationWrite, "write of property", "allowed_write_properties"
+	}
+
+	anyProps := make(map[string]bool)
+	entityProps := make(map[string]map[string]bool, len(grants))
+	for entity, list := range grants {
+		entity = strings.ToLower(entity)
+		if entityProps[entity] == nil {
+			entityProps[entity] = make(map[string]bool, len(list))
+		}
+		for _, prop := range list {
+			anyProps[strings.ToLower(prop)] = true
+			entityProps[entity][strings.ToLower(prop)] = true
+		}
+	}
+
+	// An empty entity stands for an unknown one
+	if len(entities) == 0 {
+		entities = []string{""}
+	}
+
+	var violations []Violation
+	for _, key := range keys {
+		prop := strings.ToLower(key)
+		for _, entity := range entities {
+			violation := Violation{Kind: kind, Entity: entity, Property: prop, Span: span}
+			on := ""
+			if entity != "" {
+				on = fmt.Sprintf(" on '%s'", entity)
+			}
+
+			allowed := anyProps[prop]
+			if entity != "" {
+				allowed = entityProps[entity][prop]
+			}
+
+			if rule, denied := perm.DeniedProperty(entity, prop); denied {
+				violation.RuleID = fmt.Sprintf("denied_properties[%s]", rule)
+				violation.Message = fmt.Sprintf("disallowed %s '%s'%s in %s denied by rule '%s'", verb, prop, on, source, rule)
+			} else if !allowed {
+				violation.RuleID = ruleID
+				if entity != "" {
+					violation.RuleID = fmt.Sprintf("%s[%s]", ruleID, entity)
+				}
+				violation.Message = fmt.Sprintf("disallowed %s '%s'%s in %s", verb, prop, on, source)
+			} else {
+				continue
+			}
+
+			log.Println("Property check failed:", violation.Message)
+			violations = append(violations, violation)
+		}
+	}
+
+	return violations
+}
@@ -0,0 +1,113 @@
+package analyzer
+
+import (
+	"log"
+	"strings"
+
+	"github.com/danielbahrami/se10-mt/internal/postgres"
+	"github.com/neo4j/neo4j-go-driver/v5/neo4j/dbtype"
+)
+
+// Strips the properties the permissions do not allow, or deny, from every node, relationship and path in the results
+// Whole-entity projections such as RETURN n contain no property lookups, so they are only caught here
+func RedactResults(results []map[string]any, perm *postgres.Permissions) []map[string]any {
+	entityProps := make(map[string]map[string]bool, len(perm.AllowedProperties))
+	for entity, props := range perm.AllowedProperties {
+		entity = strings.ToLower(entity)
+		if entityProps[entity] == nil {
+			entityProps[entity] = make(map[string]bool, len(props))
+		}
+		for _, prop := range props {
+			entityProps[entity][strings.ToLower(prop)] = true
+		}
+	}
+
+	r := &redactor{perm: perm, entityProps: entityProps}
+	redacted := make([]map[string]any, len(results))
+	for i, record := range results {
+		redacted[i] = r.redactMap(record)
+	}
+
+	return redacted
+}
+
+type redactor struct {
+	perm        *postgres.Permissions
+	entityProps map[string]map[string]bool // Lowercased entity -> lowercased allowed properties
+}
+
+func (r *redactor) redactValue(value any) any {
+	switch v := value.(type) {
+	case dbtype.Node:
+		return r.redactNode(v)
+	case dbtype.Relationship:
+		return r.redactRelationship(v)
+	case dbtype.Path:
+		nodes := make([]dbtype.Node, len(v.Nodes))
+		for i, node := range v.Nodes {
+			nodes[i] = r.redactNode(node)
+		}
+		rels := make([]dbtype.Relationship, len(v.Relationships))
+		for i, rel := range v.Relationships {
+			rels[i] = r.redactRelationship(rel)
+		}
+		return dbtype.Path{Nodes: nodes, Relationships: rels}
+	case []any:
+		list := make([]any, len(v))
+		for i, item := range v {
+			list[i] = r.redactValue(item)
+		}
+		return list
+	case map[string]any:
+		return r.redactMap(v)
+	default:
+		return value
+	}
+}
+
+func (r *redactor) redactMap(m map[string]any) map[string]any {
+	redacted := make(map[string]any, len(m))
+	for k, v := range m {
+		redacted[k] = r.redactValue(v)
+	}
+	return redacted
+}
+
+// A node property is kept only if every label on the node allows it and none denies it
+// Nodes with a denied label lose all of their properties
+func (r *redactor) redactNode(node dbtype.Node) dbtype.Node {
+	props := make(map[string]any, len(node.Props))
+	for prop, value := range node.Props {
+		allowed := len(node.Labels) > 0
+		for _, label := range node.Labels {
+			_, deniedLabel := r.perm.DeniedLabel(label)
+			_, deniedProp := r.perm.DeniedProperty(label, prop)
+			if deniedLabel || deniedProp || !r.entityProps[strings.ToLower(label)][strings.ToLower(prop)] {
+				allowed = false
+				break
+			}
+		}
+		if !allowed {
+			log.Printf("Redacting property '%s' from node with labels %v\n", prop, node.Labels)
+			continue
+		}
+		props[prop] = value
+	}
+	node.Props = props
+	return node
+}
+
+func (r *redactor) redactRelationship(rel dbtype.Relationship) dbtype.Relationship {
+	props := make(map[string]any, len(rel.Props))
+	_, deniedType := r.perm.DeniedRelationship(rel.Type)
+	for prop, value := range rel.Props {
+		_, deniedProp := r.perm.DeniedProperty(rel.Type, prop)
+		if deniedType || deniedProp || !r.entityProps[strings.ToLower(rel.Type)][strings.ToLower(prop)] {
+			log.Printf("Redacting property '%s' from relationship of type '%s'\n", prop, rel.Type)
+			continue
+		}
+		props[prop] = value
+	}
+	rel.Props = props
+	return rel
+}
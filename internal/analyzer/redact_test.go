@@ -0,0 +1,74 @@
+package analyzer
+
+import (
+	"io"
+	"log"
+	"maps"
+	"os"
+	"slices"
+	"testing"
+
+	"github.com/danielbahrami/se10-mt/internal/postgres"
+	"github.com/neo4j/neo4j-go-driver/v5/neo4j/dbtype"
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+func TestRedactResults(t *testing.T) {
+	perm := &postgres.Permissions{
+		AllowedLabels:        []string{"Patient", "Employee"},
+		AllowedRelationships: []string{"TREATS"},
+		AllowedProperties:    map[string][]string{"Patient": {"name", "age"}, "Employee": {"name"}, "TREATS": {"since"}},
+		DeniedLabels:         []string{"Secret"},
+	}
+	props := map[string]any{"name": "x", "age": 1, "ssn": "1"}
+
+	tests := []struct {
+		name  string
+		value any
+		want  []string // Properties kept on the redacted entity
+	}{
+		{
+			name:  "node",
+			value: dbtype.Node{Labels: []string{"Patient"}, Props: props},
+			want:  []string{"age", "name"},
+		},
+		{
+			name:  "node with several labels",
+			value: dbtype.Node{Labels: []string{"Patient", "Employee"}, Props: props},
+			want:  []string{"name"},
+		},
+		{
+			name:  "node with denied label",
+			value: dbtype.Node{Labels: []string{"Patient", "Secret"}, Props: props},
+		},
+		{
+			name:  "node without labels",
+			value: dbtype.Node{Props: props},
+		},
+		{
+			name:  "relationship",
+			value: dbtype.Relationship{Type: "TREATS", Props: map[string]any{"since": 2020, "notes": "x"}},
+			want:  []string{"since"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			results := RedactResults([]map[string]any{{"x": []any{tt.value}}}, perm)
+			var got map[string]any
+			switch v := results[0]["x"].([]any)[0].(type) {
+			case dbtype.Node:
+				got = v.Props
+			case dbtype.Relationship:
+				got = v.Props
+			}
+			if keys := slices.Sorted(maps.Keys(got)); !slices.Equal(keys, tt.want) {
+				t.Errorf("RedactResults kept %v, want %v", keys, tt.want)
+			}
+		})
+	}
+}
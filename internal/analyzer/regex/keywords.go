@@ -0,0 +1,418 @@
+package regex
+
+import (
+	"strings"
+
+	"github.com/antlr4-go/antlr/v4"
+	"github.com/danielbahrami/se10-mt/internal/analyzer"
+	"github.com/danielbahrami/se10-mt/internal/parser"
+)
+
+// A clause keyword in a query, e.g. "match", "optional match" or "detach delete", lowercased and with single spaces
+// Start and End are the byte offsets of the keyword in the query
+type keyword struct {
+	Text  string
+	Start int
+	End   int
+}
+
+// The tokens that start a clause or a part of one
+var clauseTokens = map[int]bool{
+	parser.CypherLexerOPTIONAL: true,
+	parser.CypherLexerMATCH:    true,
+	parser.CypherLexerUNWIND:   true,
+	parser.CypherLexerWITH:     true,
+	parser.CypherLexerWHERE:    true,
+	parser.CypherLexerRETURN:   true,
+	parser.CypherLexerORDER:    true,
+	parser.CypherLexerL_SKIP:   true,
+	parser.CypherLexerLIMIT:    true,
+	parser.CypherLexerUNION:    true,
+	parser.CypherLexerCALL:     true,
+	parser.CypherLexerYIELD:    true,
+	parser.CypherLexerCREATE:   true,
+	parser.CypherLexerMERGE:    true,
+	parser.CypherLexerON:       true,
+	parser.CypherLexerSET:      true,
+	parser.CypherLexerREMOVE:   true,
+	parser.CypherLexerDETACH:   true,
+	parser.CypherLexerDELETE:   true,
+}
+
+// The tokens that continue a keyword of several words, e.g. MATCH after OPTIONAL
+var keywordContinuations = map[int][]int{
+	parser.CypherLexerOPTIONAL: {parser.CypherLexerMATCH},
+	parser.CypherLexerDETACH:   {parser.CypherLexerDELETE},
+	parser.CypherLexerORDER:    {parser.CypherLexerBY},
+	parser.CypherLexerON:       {parser.CypherLexerCREATE, parser.CypherLexerMATCH},
+	parser.CypherLexerCREATE:   {parser.CypherLexerSET}, // Only after ON
+	parser.CypherLexerMATCH:    {parser.CypherLexerSET}, // Only after ON
+}
+
+// Returns the clause keywords of the query in the order they appear, skipping keyword tokens used as names, e.g. n.set
+func clauseKeywords(cypher string) []keyword {
+	tokens, offsets := tokenize(cypher)
+
+	// Keyword tokens used as variables, e.g. delete in (delete) or AS delete, are names wherever an expression can start,
+	// as in RETURN delete
+	variables := make(map[string]bool)
+
+	var keywords []keyword
+	for i := 0; i < len(tokens); i++ {
+		if !clauseTokens[tokens[i].GetTokenType()] {
+			continue
+		}
+		if isName(tokens, i) {
+			variables[strings.ToLower(tokens[i].GetText())] = true
+			continue
+		}
+		if variables[strings.ToLower(tokens[i].GetText())] && startsExpression(tokens, i) {
+			continue
+		}
+
+		// Extend the keyword with the words that continue it, e.g. ON CREATE SET
+		last := i
+		for last+1 < len(tokens) && continues(tokens[i], tokens[last], tokens[last+1]) {
+			last++
+		}
+		if tokens[i].GetTokenType() == parser.CypherLexerON && last == i {
+			continue // ON is only a keyword in ON CREATE SET and ON MATCH SET
+		}
+
+		words := make([]string, 0, last-i+1)
+		for _, t := range tokens[i : last+1] {
+			words = append(words, strings.ToLower(t.GetText()))
+		}
+		keywords = append(keywords, keyword{
+			Text:  strings.Join(words, " "),
+			Start: offsets[tokens[i].GetStart()],
+			End:   offsets[tokens[last].GetStop()+1],
+		})
+		i = last
+	}
+	return keywords
+}
+
+// Tokenizes the query with the Cypher lexer, leaving out whitespace and comments
+// Also returns the byte offset of each character offset, as token positions are character offsets
+func tokenize(cypher string) ([]antlr.Token, []int) {
+	lex := parser.NewCypherLexer(antlr.NewInputStream(cypher))
+	lex.RemoveErrorListeners()
+
+	var tokens []antlr.Token
+	for t := lex.NextToken(); t.GetTokenType() != antlr.TokenEOF; t = lex.NextToken() {
+		if t.GetTokenType() != parser.CypherLexerSP && t.GetTokenType() != parser.CypherLexerComment {
+			tokens = append(tokens, t)
+		}
+	}
+
+	offsets := make([]int, 0, len(cypher)+1)
+	for i := range cypher {
+		offsets = append(offsets, i)
+	}
+	offsets = append(offsets, len(cypher))
+	return tokens, offsets
+}
+
+// Returns the labels of label predicates such as n:Secret in WHERE n:Secret, shaped like the submatch indexes of a regex
+func labelPredicates(cypher string) [][]int {
+	tokens, offsets := tokenize(cypher)
+
+	// The kind of each open bracket: a map literal, the details of a relationship pattern or anything else
+	const (
+		mapBracket = iota
+		relBracket
+		otherBracket
+	)
+	var brackets []int
+	inside := func(kind int) bool {
+		return len(brackets) > 0 && brackets[len(brackets)-1] == kind
+	}
+
+	var locs [][]int
+	for i := 0; i < len(tokens); i++ {
+		prev := ""
+		if i > 0 {
+			prev = tokens[i-1].GetText()
+		}
+
+		switch tokens[i].GetText() {
+		case "{":
+			if i > 0 && (tokens[i-1].GetTokenType() == parser.CypherLexerEXISTS || tokens[i-1].GetTokenType() == parser.CypherLexerCALL) {
+				brackets = append(brackets, otherBracket)
+			} else {
+				brackets = append(brackets, mapBracket)
+			}
+			continue
+		case "[":
+			if prev == "-" {
+				brackets = append(brackets, relBracket)
+			} else {
+				brackets = append(brackets, otherBracket)
+			}
+			continue
+		case "(":
+			brackets = append(brackets, otherBracket)
+			continue
+		case ")", "]", "}":
+			if len(brackets) > 0 {
+				brackets = brackets[:len(brackets)-1]
+			}
+			continue
+		}
+
+		if !isIdentifier(tokens[i]) {
+			continue
+		}
+		// (n:Label) is matched as a node pattern, -[r:TYPE]- as a relationship and {key: value} is a map
+		skip := prev == "(" || (prev == "[" && inside(relBracket)) || ((prev == "{" || prev == ",") && inside(mapBracket))
+
+		j := i + 1
+		for ; j+1 < len(tokens) && tokens[j].GetText() == ":" && isIdentifier(tokens[j+1]); j += 2 {
+			if !skip {
+				start, end := offsets[tokens[j+1].GetStart()], offsets[tokens[j+1].GetStop()+1]
+				locs = append(locs, []int{start, end, start, end})
+			}
+		}
+		i = j - 1
+	}
+	return locs
+}
+
+// Returns the byte offsets of the namespaced functions the query calls, e.g. apoc.text.join, and of its procedures if set
+func namespacedCalls(cypher string, procedures bool) [][]int {
+	tokens, offsets := tokenize(cypher)
+
+	var locs [][]int
+	for i := 0; i < len(tokens); i++ {
+		if !isIdentifier(tokens[i]) || (i > 0 && tokens[i-1].GetText() == ".") {
+			continue
+		}
+
+		j := i
+		for j+2 < len(tokens) && tokens[j+1].GetText() == "." && isIdentifier(tokens[j+2]) {
+			j += 2
+		}
+		isCall := j+1 < len(tokens) && tokens[j+1].GetText() == "("
+		isProcedure := i > 0 && tokens[i-1].GetTokenType() == parser.CypherLexerCALL
+		if j > i && ((isCall && !isProcedure) || (isProcedure && procedures)) {
+			locs = append(locs, []int{offsets[tokens[i].GetStart()], offsets[tokens[j].GetStop()+1]})
+		}
+		i = j
+	}
+	return locs
+}
+
+// Reports whether the token is a name, either plain or backtick-quoted, rather than a literal or punctuation
+func isIdentifier(token antlr.Token) bool {
+	text := token.GetText()
+	if strings.HasPrefix(text, "`") {
+		return true
+	}
+	for i, c := range text {
+		isLetter := c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+		isDigit := c >= '0' && c <= '9'
+		if !isLetter && !(isDigit && i > 0) {
+			return false
+		}
+	}
+	return text != ""
+}
+
+// Reports whether the token at i is used as a name rather than a keyword, e.g. a label, property key, parameter or alias,
+// as in n.set, n:Set, $set, {set: 1} and RETURN n.name AS set, or a variable, as in set.name, (set) and -[set]-
+func isName(tokens []antlr.Token, i int) bool {
+	prev, next := "", ""
+	if i > 0 {
+		prev = tokens[i-1].GetText()
+	}
+	if i+1 < len(tokens) {
+		next = tokens[i+1].GetText()
+	}
+
+	switch {
+	case prev == "." || prev == ":" || prev == "$" || prev == "|":
+		return true
+	case i > 0 && tokens[i-1].GetTokenType() == parser.CypherLexerAS:
+		return true
+	case next == ":" || next == ".":
+		return true
+	case prev == "(" || prev == "[":
+		return next == ")" || next == "]" || next == "{"
+	}
+	return false
+}
+
+// Reports whether an expression can start at the token at i, i.e. after a clause keyword such as RETURN, BY or DISTINCT,
+// or after a comma
+func startsExpression(tokens []antlr.Token, i int) bool {
+	if i == 0 {
+		return false
+	}
+	prev := tokens[i-1]
+	switch prev.GetTokenType() {
+	case parser.CypherLexerBY, parser.CypherLexerDISTINCT:
+		return true
+	}
+	return prev.GetText() == "," || (clauseTokens[prev.GetTokenType()] && !isName(tokens, i-1))
+}
+
+// Reports whether next continues the keyword that starts with first and currently ends with last
+func continues(first, last, next antlr.Token) bool {
+	if (last.GetTokenType() == parser.CypherLexerCREATE || last.GetTokenType() == parser.CypherLexerMATCH) && first.GetTokenType() != parser.CypherLexerON {
+		return false
+	}
+	for _, t := range keywordContinuations[last.GetTokenType()] {
+		if next.GetTokenType() == t {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the node patterns without a label, e.g. (n), () or (n {name: 'x'}), as the byte offsets of their opening parenthesis
+// A parenthesized variable, e.g. RETURN (n), cannot be told apart from a node pattern without parsing, so it is returned too
+func unlabelledNodes(cypher string) [][]int {
+	tokens, offsets := tokenize(cypher)
+
+	var locs [][]int
+	for i := 0; i < len(tokens); i++ {
+		if tokens[i].GetText() != "(" {
+			continue
+		}
+		if i > 0 && isIdentifier(tokens[i-1]) && !precedesPattern(tokens[i-1]) {
+			continue // Function call, e.g. count(n)
+		}
+
+		j := i + 1
+		if j < len(tokens) && isIdentifier(tokens[j]) {
+			j++
+		}
+		if j < len(tokens) && (tokens[j].GetText() == ")" || tokens[j].GetText() == "{") {
+			locs = append(locs, []int{offsets[tokens[i].GetStart()], offsets[tokens[i].GetStop()+1]})
+		}
+	}
+	return locs
+}
+
+// Reports whether a pattern can follow the keyword token, as in MATCH (n) or WHERE NOT (n)--(), unlike a function name
+// such as count, which is a keyword too
+func precedesPattern(token antlr.Token) bool {
+	switch token.GetTokenType() {
+	case parser.CypherLexerAND, parser.CypherLexerOR, parser.CypherLexerXOR, parser.CypherLexerNOT:
+		return true
+	}
+	return clauseTokens[token.GetTokenType()]
+}
+
+// A map literal used as the properties of a node or relationship pattern, e.g. {name: 'x'} in (n:Employee {name: 'x'})
+type patternMap struct {
+	Keys  []string
+	Start int
+	End   int
+}
+
+// Returns the map literals used as the properties of node and relationship patterns, along with their keys
+func patternMaps(cypher string) []patternMap {
+	tokens, offsets := tokenize(cypher)
+
+	var maps []patternMap
+	for i := 0; i < len(tokens); i++ {
+		switch tokens[i].GetText() {
+		case "(":
+			if i > 0 && isIdentifier(tokens[i-1]) && !isKeyword(tokens[i-1]) {
+				continue // Function call, e.g. count(n)
+			}
+		case "[":
+			if i == 0 || tokens[i-1].GetText() != "-" {
+				continue
+			}
+		default:
+			continue
+		}
+
+		j := i + 1
+		if j < len(tokens) && isIdentifier(tokens[j]) {
+			j++
+		}
+		for j+1 < len(tokens) && (tokens[j].GetText() == ":" || tokens[j].GetText() == "|") {
+			if tokens[j+1].GetText() == ":" {
+				j++
+			}
+			if !isIdentifier(tokens[j+1]) {
+				break
+			}
+			j += 2
+		}
+		for j < len(tokens) && (tokens[j].GetText() == "*" || tokens[j].GetText() == ".." || tokens[j].GetTokenType() == parser.CypherLexerDecimalInteger) {
+			j++
+		}
+		if j >= len(tokens) || tokens[j].GetText() != "{" {
+			continue
+		}
+
+		m := patternMap{Start: offsets[tokens[j].GetStart()]}
+		depth := 0
+		for k := j; k < len(tokens); k++ {
+			switch tokens[k].GetText() {
+			case "{", "(", "[":
+				depth++
+			case "}", ")", "]":
+				depth--
+			}
+			if depth == 0 {
+				m.End = offsets[tokens[k].GetStop()+1]
+				i = k
+				break
+			}
+			prev := tokens[k-1].GetText()
+			if k > j && depth == 1 && (prev == "{" || prev == ",") && isIdentifier(tokens[k]) && k+1 < len(tokens) && tokens[k+1].GetText() == ":" {
+				m.Keys = append(m.Keys, analyzer.CanonicalName(tokens[k].GetText()))
+			}
+		}
+		if m.End == 0 {
+			m.End = len(cypher)
+		}
+		maps = append(maps, m)
+	}
+	return maps
+}
+
+// Returns the byte offsets of calls of properties() and keys() and of subscripts such as n['ssn'], including those of lists
+func dynamicAccesses(cypher string) [][]int {
+	tokens, offsets := tokenize(cypher)
+
+	var locs [][]int
+	for i := 0; i < len(tokens); i++ {
+		text := tokens[i].GetText()
+		start, end := offsets[tokens[i].GetStart()], offsets[tokens[i].GetStop()+1]
+		if isIdentifier(tokens[i]) && i+1 < len(tokens) && tokens[i+1].GetText() == "(" && (i == 0 || tokens[i-1].GetText() != ".") {
+			switch strings.ToLower(analyzer.CanonicalName(text)) {
+			case "properties", "keys":
+				locs = append(locs, []int{start, end})
+			}
+			continue
+		}
+		if text != "[" || i == 0 {
+			continue
+		}
+		prev := tokens[i-1]
+		switch {
+		case prev.GetText() == ")" || prev.GetText() == "]" || prev.GetText() == "}":
+		case isIdentifier(prev) && (!isKeyword(prev) || isName(tokens, i-1)):
+		default:
+			continue
+		}
+		locs = append(locs, []int{start, end})
+	}
+	return locs
+}
+
+// Reports whether the token is a Cypher keyword, e.g. RETURN or IN, rather than a name
+func isKeyword(token antlr.Token) bool {
+	names := parser.CypherLexerLexerStaticData.SymbolicNames
+	if token.GetTokenType() < 0 || token.GetTokenType() >= len(names) {
+		return false
+	}
+	return strings.EqualFold(strings.TrimPrefix(names[token.GetTokenType()], "L_"), token.GetText())
+}
@@ -5,57 +5,103 @@ import (
 	"fmt"
 	"log"
 	"regexp"
+	"slices"
 	"strings"
 
 	"github.com/danielbahrami/se10-mt/internal/analyzer"
-	"github.com/danielbahrami/se10-mt/internal/graphdb"
 	"github.com/danielbahrami/se10-mt/internal/postgres"
+	"github.com/danielbahrami/se10-mt/internal/rewriter"
 	"github.com/neo4j/neo4j-go-driver/v5/neo4j"
 )
 
-// Encapsulates the context and Neo4j driver
+// Encapsulates the Neo4j driver
 type RegexAnalyzer struct {
 	*analyzer.BaseAnalyzer
 }
 
 var _ analyzer.Analyzer = (*RegexAnalyzer)(nil)
 
+// Matches a label, relationship type or property name, which is backtick-quoted if it is not a plain identifier
+const nameRegex = "([A-Za-z0-9_]+|`(?:[^`]|``)+`)"
+
+// Matches a variable, which is backtick-quoted if it is not a plain identifier
+const variableRegex = "(?:[A-Za-z_][A-Za-z0-9_]*|`(?:[^`]|``)+`)"
+
+// Matches the labels of a node pattern, e.g. :Employee:Manager, and the types of a relationship pattern, e.g. :A|B or :A|:B
+const (
+	labelsRegex   = `((?::\s*` + nameRegex + `\s*)+)`
+	relTypesRegex = `(:\s*` + nameRegex + `(?:\s*\|\s*:?\s*` + nameRegex + `)*)`
+)
+
+// Matches a relationship without a type, e.g. -[r]-, -[*1..3]- or -->
+const untypedRelationshipRegex = `-\[\s*` + variableRegex + `?\s*(?:\*[0-9. ]*)?\s*(?:\{[^}]*\})?\s*\]|--`
+
 // Holds the outcome of a query analysis
 type AnalysisResult = analyzer.AnalysisResult
 
 // Creates a new Analyzer instance
-func New(ctx context.Context, driver neo4j.DriverWithContext) *RegexAnalyzer {
-	return &RegexAnalyzer{BaseAnalyzer: analyzer.NewBaseAnalyzer(ctx, driver)}
+func New(driver neo4j.DriverWithContext) *RegexAnalyzer {
+	return &RegexAnalyzer{BaseAnalyzer: analyzer.NewBaseAnalyzer(driver)}
 }
 
-func (analyzer *RegexAnalyzer) analyzeQuery(cypher string, perm *postgres.Permissions) (*AnalysisResult, error) {
+func (r *RegexAnalyzer) analyzeQuery(cypher string, params map[string]any, perm *postgres.Permissions) (*AnalysisResult, error) {
 	log.Println("Analyzing the following query:", cypher)
-	analysis := &AnalysisResult{Allowed: true, Violations: []string{}}
+
+	// Normalize the query first, so comments, backticks and escapes cannot hide names from the regexes
+	// Spans are mapped back to the original query
+	query := analyzer.NormalizeQuery(cypher)
+	normalized := query.Text
+	analysis := &AnalysisResult{Allowed: true, Violations: []analyzer.Violation{}}
 	initialViolations := len(analysis.Violations)
 
 	// Node Label Check
-	// Use regex that matches node definitions in parentheses
-	nodeLabelRegex, err := regexp.Compile(`\(\s*[A-Za-z0-9]*\s*:\s*([A-Za-z0-9_]+)`)
+	// Use regex that matches node definitions in parentheses along with all of their labels
+	nodeLabelRegex, err := regexp.Compile(`\(\s*` + variableRegex + `?\s*` + labelsRegex)
+	if err != nil {
+		return nil, fmt.Errorf("%s", err.Error())
+	}
+	labelNameRegex, err := regexp.Compile(nameRegex)
 	if err != nil {
 		return nil, fmt.Errorf("%s", err.Error())
 	}
 
-	labelMatches := nodeLabelRegex.FindAllStringSubmatch(cypher, -1)
+	var labelMatches [][]int
+	for _, loc := range nodeLabelRegex.FindAllStringSubmatchIndex(normalized, -1) {
+		labelMatches = append(labelMatches, submatches(labelNameRegex, normalized, loc[2], loc[3])...)
+	}
+	labelMatches = append(labelMatches, labelPredicates(normalized)...)
 	allowedLabels := make(map[string]bool)
 	for _, l := range perm.AllowedLabels {
 		allowedLabels[strings.ToLower(l)] = true
 	}
 
 	labelsFound := make(map[string]bool)
-	for _, match := range labelMatches {
-		if len(match) < 2 {
+	for _, loc := range labelMatches {
+		if len(loc) < 4 {
 			continue
 		}
-		label := strings.ToLower(match[1])
+		match, span := normalized[loc[2]:loc[3]], query.SpanAt(loc[2], loc[3])
+		label := strings.ToLower(analyzer.CanonicalName(match))
 		labelsFound[label] = true
-		if !allowedLabels[label] {
-			log.Printf("Label check failed: label '%s' is not allowed", match[1])
-			analysis.Violations = append(analysis.Violations, fmt.Sprintf("disallowed label '%s'", match[1]))
+		if rule, denied := perm.DeniedLabel(label); denied {
+			log.Printf("Label check failed: label '%s' is denied by rule '%s'", match, rule)
+			analysis.Violations = append(analysis.Violations, analyzer.Violation{
+				Kind:    analyzer.ViolationLabel,
+				Entity:  label,
+				Span:    span,
+				RuleID:  fmt.Sprintf("denied_labels[%s]", rule),
+				Message: fmt.Sprintf("denied label '%s' (rule '%s')", match, rule),
+			})
+			analysis.Allowed = false
+		} else if !allowedLabels[label] {
+			log.Printf("Label check failed: label '%s' is not allowed", match)
+			analysis.Violations = append(analysis.Violations, analyzer.Violation{
+				Kind:    analyzer.ViolationLabel,
+				Entity:  label,
+				Span:    span,
+				RuleID:  "allowed_labels",
+				Message: fmt.Sprintf("disallowed label '%s'", match),
+			})
 			analysis.Allowed = false
 		}
 	}
@@ -68,25 +114,47 @@ func (analyzer *RegexAnalyzer) analyzeQuery(cypher string, perm *postgres.Permis
 
 	// Relationship Check
 	initialViolations = len(analysis.Violations)
-	relRegex, err := regexp.Compile(`-\[\s*[^\]]*:\s*([A-Za-z0-9_]+)`)
+	relRegex, err := regexp.Compile(`-\[\s*` + variableRegex + `?\s*` + relTypesRegex)
 	if err != nil {
 		return nil, fmt.Errorf("%s", err.Error())
 	}
 
-	relMatches := relRegex.FindAllStringSubmatch(cypher, -1)
+	var relMatches [][]int
+	for _, loc := range relRegex.FindAllStringSubmatchIndex(normalized, -1) {
+		relMatches = append(relMatches, submatches(labelNameRegex, normalized, loc[2], loc[3])...)
+	}
 	allowedRels := make(map[string]bool)
 	for _, rel := range perm.AllowedRelationships {
 		allowedRels[strings.ToLower(rel)] = true
 	}
 
-	for _, match := range relMatches {
-		if len(match) < 2 {
+	relsFound := make(map[string]bool)
+	for _, loc := range relMatches {
+		if len(loc) < 4 {
 			continue
 		}
-		relType := strings.ToLower(match[1])
-		if !allowedRels[relType] {
-			log.Printf("Relationship check failed: relationship type '%s' is not allowed", match[1])
-			analysis.Violations = append(analysis.Violations, fmt.Sprintf("disallowed relationship type '%s'", match[1]))
+		match, span := normalized[loc[2]:loc[3]], query.SpanAt(loc[2], loc[3])
+		relType := strings.ToLower(analyzer.CanonicalName(match))
+		relsFound[relType] = true
+		if rule, denied := perm.DeniedRelationship(relType); denied {
+			log.Printf("Relationship check failed: relationship type '%s' is denied by rule '%s'", match, rule)
+			analysis.Violations = append(analysis.Violations, analyzer.Violation{
+				Kind:    analyzer.ViolationRelationship,
+				Entity:  relType,
+				Span:    span,
+				RuleID:  fmt.Sprintf("denied_relationships[%s]", rule),
+				Message: fmt.Sprintf("denied relationship type '%s' (rule '%s')", match, rule),
+			})
+			analysis.Allowed = false
+		} else if !allowedRels[relType] {
+			log.Printf("Relationship check failed: relationship type '%s' is not allowed", match)
+			analysis.Violations = append(analysis.Violations, analyzer.Violation{
+				Kind:    analyzer.ViolationRelationship,
+				Entity:  relType,
+				Span:    span,
+				RuleID:  "allowed_relationships",
+				Message: fmt.Sprintf("disallowed relationship type '%s'", match),
+			})
 			analysis.Allowed = false
 		}
 	}
@@ -97,14 +165,134 @@ func (analyzer *RegexAnalyzer) analyzeQuery(cypher string, perm *postgres.Permis
 		log.Println("Relationship check completed with violations")
 	}
 
+	// Row Filter Check
+	initialViolations = len(analysis.Violations)
+	rowFilters := []struct {
+		field   string
+		filters map[string][]string
+		found   map[string]bool
+	}{
+		{"row_filters", perm.RowFilters, labelsFound},
+		{"relationship_row_filters", perm.RelationshipRowFilters, relsFound},
+	}
+	for _, rf := range rowFilters {
+		for entity := range rf.filters {
+			entity = strings.ToLower(entity)
+			if !rf.found[entity] {
+				continue
+			}
+			log.Printf("Row filter check failed: entity '%s' has row filters", entity)
+			analysis.Violations = append(analysis.Violations, unsupported(analyzer.Violation{
+				Kind:    analyzer.ViolationRowFilter,
+				Entity:  entity,
+				RuleID:  fmt.Sprintf("%s[%s]", rf.field, entity),
+				Message: fmt.Sprintf("row filters on '%s' require the parser analyzer", entity),
+			}))
+			analysis.Allowed = false
+		}
+	}
+
+	// Unlabelled nodes and untyped relationships may bind a filtered label or type, e.g. n in MATCH (n)
+	if len(perm.RowFilters) > 0 {
+		for _, loc := range unlabelledNodes(normalized) {
+			log.Println("Row filter check failed: unlabelled node may have a label with row filters")
+			analysis.Violations = append(analysis.Violations, unsupported(analyzer.Violation{
+				Kind:    analyzer.ViolationRowFilter,
+				Span:    query.SpanAt(loc[0], loc[1]),
+				RuleID:  "row_filters",
+				Message: "unlabelled nodes require the parser analyzer when labels have row filters",
+			}))
+			analysis.Allowed = false
+		}
+	}
+	if len(perm.RelationshipRowFilters) > 0 {
+		untypedRelRegex, err := regexp.Compile(untypedRelationshipRegex)
+		if err != nil {
+			return nil, fmt.Errorf("%s", err.Error())
+		}
+		for _, loc := range untypedRelRegex.FindAllStringIndex(normalized, -1) {
+			log.Println("Row filter check failed: untyped relationship may have a type with row filters")
+			analysis.Violations = append(analysis.Violations, unsupported(analyzer.Violation{
+				Kind:    analyzer.ViolationRowFilter,
+				Span:    query.SpanAt(loc[0], loc[1]),
+				RuleID:  "relationship_row_filters",
+				Message: "untyped relationships require the parser analyzer when relationship types have row filters",
+			}))
+			analysis.Allowed = false
+		}
+	}
+
+	if len(analysis.Violations) == initialViolations {
+		log.Println("Row filter check passed")
+	} else {
+		log.Println("Row filter check completed with violations")
+	}
+
+	// Procedure Check
+	initialViolations = len(analysis.Violations)
+	keywords := clauseKeywords(normalized)
+	for _, kw := range keywords {
+		if kw.Text != "call" {
+			continue
+		}
+		log.Println("Procedure check failed: procedure calls are not allowed")
+		analysis.Violations = append(analysis.Violations, unsupported(analyzer.Violation{
+			Kind:    analyzer.ViolationProcedure,
+			Span:    query.SpanAt(kw.Start, kw.End),
+			RuleID:  "allowed_procedures",
+			Message: "procedure calls require the parser analyzer",
+		}))
+		analysis.Allowed = false
+	}
+
+	// Namespaced functions, e.g. apoc.cypher.runFirstColumn, can run queries of their own just like procedures
+	for _, loc := range namespacedCalls(normalized, false) {
+		name := normalized[loc[0]:loc[1]]
+		log.Printf("Procedure check failed: namespaced function '%s' is not allowed", name)
+		analysis.Violations = append(analysis.Violations, unsupported(analyzer.Violation{
+			Kind:    analyzer.ViolationFunction,
+			Entity:  name,
+			Span:    query.SpanAt(loc[0], loc[1]),
+			RuleID:  "allowed_functions",
+			Message: "namespaced function calls require the parser analyzer",
+		}))
+		analysis.Allowed = false
+	}
+
+	if len(analysis.Violations) == initialViolations {
+		log.Println("Procedure check passed")
+	} else {
+		log.Println("Procedure check completed with violations")
+	}
+
+	// Dynamic Property Access Check
+	initialViolations = len(analysis.Violations)
+	for _, loc := range dynamicAccesses(normalized) {
+		form := normalized[loc[0]:loc[1]]
+		log.Printf("Dynamic property access check failed: '%s' is not allowed", form)
+		analysis.Violations = append(analysis.Violations, unsupported(analyzer.Violation{
+			Kind:    analyzer.ViolationDynamic,
+			Span:    query.SpanAt(loc[0], loc[1]),
+			RuleID:  "allowed_properties",
+			Message: "dynamic property access requires the parser analyzer",
+		}))
+		analysis.Allowed = false
+	}
+
+	if len(analysis.Violations) == initialViolations {
+		log.Println("Dynamic property access check passed")
+	} else {
+		log.Println("Dynamic property access check completed with violations")
+	}
+
 	// Property Check
 	initialViolations = len(analysis.Violations)
-	propRegex, err := regexp.Compile(`\.\s*([A-Za-z0-9_]+)`)
+	propRegex, err := regexp.Compile(`\.\s*` + nameRegex)
 	if err != nil {
 		return nil, fmt.Errorf("%s", err.Error())
 	}
 
-	propMatches := propRegex.FindAllStringSubmatch(cypher, -1)
+	propMatches := propRegex.FindAllStringSubmatchIndex(normalized, -1)
 	allowedProps := make(map[string]bool)
 	for _, props := range perm.AllowedProperties {
 		for _, prop := range props {
@@ -112,14 +300,40 @@ func (analyzer *RegexAnalyzer) analyzeQuery(cypher string, perm *postgres.Permis
 		}
 	}
 
-	for _, match := range propMatches {
-		if len(match) < 2 {
+	// The dots of called names, e.g. db.labels in CALL db.labels(), are not property lookups
+	calls := namespacedCalls(normalized, true)
+	isCall := func(i int) bool {
+		return slices.ContainsFunc(calls, func(loc []int) bool { return loc[0] <= i && i < loc[1] })
+	}
+
+	propsFound := make(map[string]bool)
+	for _, loc := range propMatches {
+		if len(loc) < 4 || afterNumber(normalized, loc[0]) || isCall(loc[0]) {
 			continue
 		}
-		prop := strings.ToLower(match[1])
-		if !allowedProps[prop] {
-			log.Printf("Property check failed: property '%s' is not allowed", match[1])
-			analysis.Violations = append(analysis.Violations, fmt.Sprintf("disallowed property '%s'", match[1]))
+		match, span := normalized[loc[2]:loc[3]], query.SpanAt(loc[2], loc[3])
+		prop := strings.ToLower(analyzer.CanonicalName(match))
+		propsFound[prop] = true
+		// Properties are not tied to an entity here, so a property denied on any entity is denied
+		if rule, denied := perm.DeniedProperty("", prop); denied {
+			log.Printf("Property check failed: property '%s' is denied by rule '%s'", match, rule)
+			analysis.Violations = append(analysis.Violations, analyzer.Violation{
+				Kind:     analyzer.ViolationProperty,
+				Property: prop,
+				Span:     span,
+				RuleID:   fmt.Sprintf("denied_properties[%s]", rule),
+				Message:  fmt.Sprintf("disallowed property '%s' denied by rule '%s'", match, rule),
+			})
+			analysis.Allowed = false
+		} else if !allowedProps[prop] {
+			log.Printf("Property check failed: property '%s' is not allowed", match)
+			analysis.Violations = append(analysis.Violations, analyzer.Violation{
+				Kind:     analyzer.ViolationProperty,
+				Property: prop,
+				Span:     span,
+				RuleID:   "allowed_properties",
+				Message:  fmt.Sprintf("disallowed property '%s'", match),
+			})
 			analysis.Allowed = false
 		}
 	}
@@ -130,155 +344,358 @@ func (analyzer *RegexAnalyzer) analyzeQuery(cypher string, perm *postgres.Permis
 		log.Printf("Property check completed with violations. Allowed properties: %+v\n", allowedProps)
 	}
 
-	// Operation Check
+	// Parameter Check
+	// Use regex that matches parameters used as the properties of node and relationship patterns
 	initialViolations = len(analysis.Violations)
-	lowerQuery := strings.ToLower(cypher)
-	operation := "read" // default for MATCH queries
-	if strings.Contains(lowerQuery, "create") {
-		operation = "create"
-	} else if strings.Contains(lowerQuery, "set") {
-		operation = "update"
-	} else if strings.Contains(lowerQuery, "delete") {
-		operation = "delete"
-	}
-
-	// Normalize the operation permissions keys
-	opPerms := make(map[string]postgres.OperationPermissions)
-	for k, v := range perm.OperationPermissions {
-		opPerms[strings.ToLower(k)] = v
-	}
-
-	for label := range labelsFound {
-		if perms, ok := opPerms[label]; ok {
-			log.Printf("For label '%s': operation '%s', permission read=%v\n", label, operation, perms.Read)
-			var allowed bool
-			switch operation {
-			case "read":
-				allowed = perms.Read
-			case "create":
-				allowed = perms.Create
-			case "update":
-				allowed = perms.Update
-			case "delete":
-				allowed = perms.Delete
-			}
-			if !allowed {
-				log.Printf("Operation check failed for label '%s' for operation '%s'\n", label, operation)
-				analysis.Violations = append(analysis.Violations, fmt.Sprintf("operation '%s' is not allowed on label '%s'", operation, label))
-				analysis.Allowed = false
+	paramRegex, err := regexp.Compile(`[(\[][^()\[\]]*\$([A-Za-z_][A-Za-z0-9_]*)\s*[)\]]`)
+	if err != nil {
+		return nil, fmt.Errorf("%s", err.Error())
+	}
+
+	for _, loc := range paramRegex.FindAllStringSubmatchIndex(normalized, -1) {
+		if len(loc) < 4 {
+			continue
+		}
+		name, span := normalized[loc[2]:loc[3]], query.SpanAt(loc[2], loc[3])
+		keys, ok := analyzer.ParameterKeys(params[name])
+		if !ok {
+			continue
+		}
+		violations := analyzer.CheckKeyedProperties(perm, keys, fmt.Sprintf("parameter '%s'", name), nil, span, false)
+		if len(violations) > 0 {
+			analysis.Violations = append(analysis.Violations, violations...)
+			analysis.Allowed = false
+		}
+	}
+
+	if len(analysis.Violations) == initialViolations {
+		log.Println("Parameter check passed")
+	} else {
+		log.Println("Parameter check completed with violations")
+	}
+
+	// Map Key Check
+	// CREATE writes the keys of pattern maps, MATCH matches them, and MERGE does either
+	initialViolations = len(analysis.Violations)
+	for _, m := range patternMaps(normalized) {
+		clause := ""
+		for _, kw := range keywords {
+			if kw.Start <= m.Start {
+				clause = kw.Text
 			}
 		}
+		span := query.SpanAt(m.Start, m.End)
+		if clause != "create" {
+			analysis.Violations = append(analysis.Violations, analyzer.CheckKeyedProperties(perm, m.Keys, "map literal", nil, span, false)...)
+		}
+		if clause == "create" || clause == "merge" {
+			analysis.Violations = append(analysis.Violations, analyzer.CheckKeyedProperties(perm, m.Keys, "map literal", nil, span, true)...)
+		}
+	}
+
+	if len(analysis.Violations) == initialViolations {
+		log.Println("Map key check passed")
+	} else {
+		log.Println("Map key check completed with violations")
+		analysis.Allowed = false
+	}
+
+	// Operation Check
+	// The query is split into clauses, and each clause performs its operations on the labels and relationship types it touches
+	initialViolations = len(analysis.Violations)
+	labelOps, relOps, err := clauseOperations(query, keywords, labelMatches, relMatches, labelNameRegex)
+	if err != nil {
+		return nil, err
+	}
+
+	if violations := analyzer.CheckOperations(perm, labelOps, relOps); len(violations) > 0 {
+		analysis.Violations = append(analysis.Violations, violations...)
+		analysis.Allowed = false
 	}
 
 	if len(analysis.Violations) == initialViolations {
-		log.Printf("Operation check passed. Operation: %s\n", operation)
+		log.Printf("Operation check passed. Labels: %v. Relationship types: %v\n", labelOps, relOps)
 	} else {
-		log.Printf("Operation check completed with violations. Operation: %s\n", operation)
+		log.Printf("Operation check completed with violations. Labels: %v. Relationship types: %v\n", labelOps, relOps)
 	}
 
+	analysis.Entities = analyzer.NewEntities(labelsFound, relsFound, propsFound)
+
 	log.Println("Analysis complete with violations:", analysis.Violations)
 	return analysis, nil
 }
 
-func (r *RegexAnalyzer) rewriteQuery(cypher string, analysis *AnalysisResult) (string, bool, error) {
-	log.Println("Attempting to rewrite the query. Violations:", analysis.Violations)
-
-	// Determine if there are any violations other than disallowed properties
-	nonPropertyViolations := false
-	var disallowedProps []string
-	for _, v := range analysis.Violations {
-		if !strings.HasPrefix(v, "disallowed property") {
-			nonPropertyViolations = true
-			break
-		} else {
-			parts := strings.Split(v, "'")
-			if len(parts) >= 2 {
-				disallowedProps = append(disallowedProps, parts[1])
-			}
-		}
+// Returns the operations the clauses of the query perform on each label and relationship type
+// Variables that are not bound to a label or type in a pattern may be bound to any
+func clauseOperations(query *analyzer.NormalizedQuery, keywords []keyword, labelMatches, relMatches [][]int, labelNameRegex *regexp.Regexp) (analyzer.Operations, analyzer.Operations, error) {
+	cypher := query.Text
+	// Variables bound to labels or types in a pattern, e.g. e in (e:Employee:Manager) and r in -[r:WORKS_ON|MANAGES]-
+	nodeBindingRegex, err := regexp.Compile(`\(\s*([A-Za-z_][A-Za-z0-9_]*)\s*` + labelsRegex)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s", err.Error())
 	}
-
-	if nonPropertyViolations {
-		log.Println("Rewriting not possible due to violations other than disallowed properties")
-		return "", false, fmt.Errorf("Cannot safely rewrite the query")
+	relBindingRegex, err := regexp.Compile(`-\[\s*([A-Za-z_][A-Za-z0-9_]*)\s*` + relTypesRegex)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s", err.Error())
 	}
-
-	// Extract the RETURN clause from the query
-	// This assumes the RETURN clause is at the end of the query
-	retRegex, err := regexp.Compile(`(?i)return\s+(.+)$`)
+	// Path variables, e.g. p in p = (...)
+	pathRegex, err := regexp.Compile(`([A-Za-z_][A-Za-z0-9_]*)\s*=\s*\(`)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s", err.Error())
+	}
+	untypedRelRegex, err := regexp.Compile(untypedRelationshipRegex)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s", err.Error())
+	}
+	// Variables introduced by AS, e.g. x in WITH e AS x or UNWIND list AS x
+	aliasRegex, err := regexp.Compile(`(?i)\bAS\s+([A-Za-z_][A-Za-z0-9_]*)`)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s", err.Error())
+	}
+	// The variable a SET or REMOVE item writes to, e.g. e in e.name = 'x', e += $props or e:Manager
+	itemTargetRegex, err := regexp.Compile(`^\s*([A-Za-z_][A-Za-z0-9_]*)\s*(?:\.|\+?=|:)`)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s", err.Error())
+	}
+	// Labels added or removed by SET and REMOVE items, e.g. e:Manager
+	itemLabelRegex, err := regexp.Compile(`^\s*[A-Za-z_][A-Za-z0-9_]*\s*` + labelsRegex)
 	if err != nil {
-		return "", false, fmt.Errorf("%s", err.Error())
+		return nil, nil, fmt.Errorf("%s", err.Error())
+	}
+	identifierRegex, err := regexp.Compile(`[A-Za-z_][A-Za-z0-9_]*`)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s", err.Error())
 	}
 
-	matches := retRegex.FindStringSubmatch(cypher)
-	if len(matches) < 2 {
-		log.Println("Rewriting fails due to no RETURN clause being found")
-		return "", false, fmt.Errorf("Cannot safely rewrite the query")
+	varLabels := make(map[string]map[string]bool)
+	varRelTypes := make(map[string]map[string]bool)
+	bind := func(bindings map[string]map[string]bool, variable, name string) {
+		if bindings[variable] == nil {
+			bindings[variable] = make(map[string]bool)
+		}
+		bindings[variable][strings.ToLower(analyzer.CanonicalName(name))] = true
+	}
+	for _, m := range nodeBindingRegex.FindAllStringSubmatch(cypher, -1) {
+		for _, label := range labelNameRegex.FindAllString(m[2], -1) {
+			bind(varLabels, m[1], label)
+		}
+	}
+	for _, m := range relBindingRegex.FindAllStringSubmatch(cypher, -1) {
+		for _, relType := range labelNameRegex.FindAllString(m[2], -1) {
+			bind(varRelTypes, m[1], relType)
+		}
+	}
+	aliases := make(map[string]bool)
+	for _, m := range aliasRegex.FindAllStringSubmatch(cypher, -1) {
+		aliases[m[1]] = true
 	}
 
-	originalReturnClause := matches[1]
+	// Each clause runs from its keyword to the next clause keyword
+	labelOps, relOps := make(analyzer.Operations), make(analyzer.Operations)
+	for i, kw := range keywords {
+		start, end := kw.Start, len(cypher)
+		if i+1 < len(keywords) {
+			end = keywords[i+1].Start
+		}
+		clause := cypher[start:end]
+		paths := pathRegex.FindAllStringSubmatch(clause, -1)
+		if untypedRelRegex.MatchString(clause) {
+			for _, path := range paths {
+				bind(varRelTypes, path[1], analyzer.AnyRelationship)
+			}
+		}
 
-	// Split the RETURN clause into individual fields
-	fields := strings.Split(originalReturnClause, ",")
-	var allowedFields []string
+		// Labels and relationship types in the clause's patterns
+		var labels, relTypes []string
+		for _, m := range labelMatches {
+			if m[2] >= start && m[3] <= end {
+				labels = append(labels, analyzer.CanonicalName(cypher[m[2]:m[3]]))
+				for _, path := range paths {
+					bind(varLabels, path[1], cypher[m[2]:m[3]])
+				}
+			}
+		}
+		for _, m := range relMatches {
+			if m[2] >= start && m[3] <= end {
+				relTypes = append(relTypes, analyzer.CanonicalName(cypher[m[2]:m[3]]))
+				for _, path := range paths {
+					bind(varRelTypes, path[1], cypher[m[2]:m[3]])
+				}
+			}
+		}
 
-fieldLoop:
-	for _, field := range fields {
-		trimmed := strings.TrimSpace(field)
+		span := query.SpanAt(start, end)
+		// Adds the operations to the entities in the clause's patterns
+		addPatterns := func(operations ...string) {
+			for _, operation := range operations {
+				for _, label := range labels {
+					labelOps.Add(label, operation, span)
+				}
+				for _, relType := range relTypes {
+					relOps.Add(relType, operation, span)
+				}
+			}
+		}
+		// Adds the operation to the entities bound to the variables, or to any label and type if they are not known
+		addVariables := func(operation string, variables []string) {
+			for _, variable := range variables {
+				labels, relTypes := varLabels[variable], varRelTypes[variable]
+				if aliases[variable] || (len(labels) == 0 && len(relTypes) == 0) {
+					labelOps.Add(analyzer.AnyLabel, operation, span)
+					relOps.Add(analyzer.AnyRelationship, operation, span)
+				}
+				for label := range labels {
+					labelOps.Add(label, operation, span)
+				}
+				for relType := range relTypes {
+					relOps.Add(relType, operation, span)
+				}
+			}
+		}
+		// Returns the variables the items of a DELETE reference, leaving out function names and property keys
+		referenced := func() []string {
+			var variables []string
+			items := cypher[kw.End:end]
+			for _, loc := range identifierRegex.FindAllStringIndex(items, -1) {
+				before, after := strings.TrimRight(items[:loc[0]], " "), strings.TrimLeft(items[loc[1]:], " ")
+				if strings.HasSuffix(before, ".") || strings.HasPrefix(after, "(") {
+					continue
+				}
+				variables = append(variables, items[loc[0]:loc[1]])
+			}
+			return variables
+		}
 
-		// Skip fields that reference any disallowed property
-		for _, prop := range disallowedProps {
-			if strings.Contains(strings.ToLower(trimmed), "."+strings.ToLower(prop)) {
-				log.Printf("Removing field '%s' due to disallowed property '%s'\n", trimmed, prop)
-				continue fieldLoop
+		switch kw.Text {
+		case "create":
+			addPatterns(analyzer.OperationCreate)
+		case "merge":
+			addPatterns(analyzer.OperationRead, analyzer.OperationCreate)
+		case "set", "on create set", "on match set", "remove":
+			var targets []string
+			for _, item := range splitItems(cypher[kw.End:end]) {
+				if m := itemLabelRegex.FindStringSubmatch(item); m != nil {
+					for _, label := range labelNameRegex.FindAllString(m[1], -1) {
+						labelOps.Add(analyzer.CanonicalName(label), analyzer.OperationUpdate, span)
+					}
+				}
+				if m := itemTargetRegex.FindStringSubmatch(item); m != nil {
+					targets = append(targets, m[1])
+				}
 			}
+			addVariables(analyzer.OperationUpdate, targets)
+		case "delete":
+			addVariables(analyzer.OperationDelete, referenced())
+		case "detach delete":
+			addVariables(analyzer.OperationDelete, referenced())
+			relOps.Add(analyzer.AnyRelationship, analyzer.OperationDelete, span)
+		default:
+			addPatterns(analyzer.OperationRead)
 		}
-		allowedFields = append(allowedFields, trimmed)
 	}
+	return labelOps, relOps, nil
+}
 
-	if len(allowedFields) == 0 {
-		log.Println("Rewriting fails due to resulting in an empty RETURN clause")
-		return "", false, fmt.Errorf("Cannot safely rewrite the query")
+// Reports whether the dot at byte offset i belongs to a number or a range, as in 1.5 or *1..2, rather than a property lookup
+func afterNumber(text string, i int) bool {
+	before := strings.TrimRight(text[:i], " \t\r\n")
+	if strings.HasSuffix(before, ".") {
+		return true
 	}
+	rest := strings.TrimRight(before, "0123456789")
+	if len(rest) == len(before) {
+		return false
+	}
+	// Names may end in digits, e.g. x1.name
+	if rest == "" {
+		return true
+	}
+	c := rest[len(rest)-1]
+	return !(c == '_' || c == '`' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z'))
+}
 
-	// Rebuild the new RETURN clause
-	newReturnClause := "RETURN " + strings.Join(allowedFields, ", ")
+// Splits the text of a clause into its comma-separated items, ignoring commas inside brackets, string literals and quoted names
+func splitItems(text string) []string {
+	var items []string
+	depth, start := 0, 0
+	var quote byte
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case quote != 0:
+			if c == '\\' && quote != '`' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"' || c == '`':
+			quote = c
+		case c == '(' || c == '[' || c == '{':
+			depth++
+		case c == ')' || c == ']' || c == '}':
+			depth--
+		case c == ',' && depth == 0:
+			items = append(items, text[start:i])
+			start = i + 1
+		}
+	}
+	return append(items, text[start:])
+}
 
-	// Replace the original RETURN clause with the new one
-	rewrittenQuery := retRegex.ReplaceAllString(cypher, newReturnClause)
-	log.Println("Rewriting succeeded. New query:", rewrittenQuery)
-	return rewrittenQuery, true, nil // 'true' indicates a rewritten query was returned
+// Marks a violation of a rule only the parser analyzer can check, i.e. row filters, procedure calls, namespaced
+// functions and dynamic property accesses, which are blocked here without a verdict on whether the rules allow them
+func unsupported(v analyzer.Violation) analyzer.Violation {
+	v.Unsupported = true
+	return v
 }
 
-func (r *RegexAnalyzer) AnalyzeAndExecute(cypher string, perm *postgres.Permissions) ([]map[string]any, bool, string, []string, error) {
-	log.Println("Analyzing with Regex Analyzer...")
-	analysis, err := r.analyzeQuery(cypher, perm)
+// Returns the indexes of each match of the regex between start and end, shaped like the submatch indexes of a regex
+// with one group, so loc[2] and loc[3] delimit the match
+func submatches(re *regexp.Regexp, text string, start, end int) [][]int {
+	var locs [][]int
+	for _, loc := range re.FindAllStringIndex(text[start:end], -1) {
+		locs = append(locs, []int{start + loc[0], start + loc[1], start + loc[0], start + loc[1]})
+	}
+	return locs
+}
+
+func (r *RegexAnalyzer) Analyze(ctx context.Context, cypher string, params map[string]any, principal *analyzer.Principal) (*analyzer.Decision, error) {
+	decision := &analyzer.Decision{Status: analyzer.DecisionAllowed, Query: cypher, Parameters: params}
+	decision.Tracef("Analyzing with Regex Analyzer...")
+	analysis, err := r.analyzeQuery(cypher, params, principal.Permissions)
 	if err != nil {
-		return nil, false, "", nil, err
+		return nil, err
 	}
+	decision.Violations, decision.Entities = analysis.Violations, analysis.Entities
 
-	// Execute the query if it passed analysis
 	if analysis.Allowed {
-		log.Println("Query deemed safe. Executing original query...")
-		results, err := graphdb.QueryHandler(r.Ctx, r.Driver, cypher)
-		if err != nil {
-			return nil, false, "", analysis.Violations, fmt.Errorf("%s", err.Error())
-		}
-		return results, false, "", analysis.Violations, nil
+		decision.Tracef("Query deemed safe")
+		return decision, nil
 	}
 
 	// Otherwise attempt to rewrite the query
-	log.Println("Query is unsafe. Attempting to rewrite...")
-	rewrittenQuery, wasRewritten, err := r.rewriteQuery(cypher, analysis)
-	if err != nil {
-		return nil, wasRewritten, rewrittenQuery, analysis.Violations, analyzer.ForbiddenQueryErr
+	decision.Tracef("Query is unsafe. Attempting to rewrite...")
+	// Only disallowed properties are rewritten here, as dynamic property accesses are not located on the parse-tree
+	for _, v := range analysis.Violations {
+		if v.Kind != analyzer.ViolationProperty {
+			decision.Tracef("Rewriting failed: violations other than disallowed properties")
+			return decision.Block(), nil
+		}
 	}
-
-	log.Println("Rewritten query accepted. Executing rewritten query...")
-	results, err := graphdb.QueryHandler(r.Ctx, r.Driver, rewrittenQuery)
+	rewrittenQuery, rewritten, err := rewriter.RewriteQuery(cypher, analysis.Violations, principal.Permissions.Strictness)
 	if err != nil {
-		return nil, wasRewritten, rewrittenQuery, analysis.Violations, fmt.Errorf("%s", err.Error())
+		decision.Tracef("Rewriting failed: %s", err)
+		return decision.Block(), nil
+	}
+	if !rewritten {
+		// The violations did not apply to the query, so an allowed decision does not report them
+		decision.Violations = nil
+		decision.Tracef("Nothing to rewrite. Query deemed safe")
+		return decision, nil
 	}
 
-	return results, wasRewritten, rewrittenQuery, analysis.Violations, nil
+	decision.Status, decision.Query = analyzer.DecisionRewritten, rewrittenQuery
+	decision.Parameters = analyzer.RewriteParameters(params, principal.Attributes)
+	decision.Tracef("Removed disallowed properties: %s", rewrittenQuery)
+	return decision, nil
 }
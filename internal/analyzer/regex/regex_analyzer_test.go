@@ -0,0 +1,410 @@
+package regex
+
+import (
+	"context"
+	"io"
+	"log"
+	"os"
+	"testing"
+
+	"github.com/danielbahrami/se10-mt/internal/analyzer"
+	"github.com/danielbahrami/se10-mt/internal/analyzer/analyzertest"
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+func TestAnalyze(t *testing.T) {
+	tests := []struct {
+		name   string
+		query  string
+		params map[string]any
+		status analyzer.DecisionStatus
+		want   string
+	}{
+		{
+			name:   "allowed property",
+			query:  "MATCH (p:Patient) RETURN p.name",
+			status: analyzer.DecisionAllowed,
+			want:   "MATCH (p:Patient) RETURN p.name",
+		},
+		{
+			name:   "disallowed property removed",
+			query:  "MATCH (p:Patient) RETURN p.name, p.ssn",
+			status: analyzer.DecisionRewritten,
+			want:   "MATCH (p:Patient) RETURN p.name",
+		},
+		{
+			name:   "decimal number",
+			query:  "MATCH (p:Patient) RETURN p.name, 1.5 AS x",
+			status: analyzer.DecisionAllowed,
+			want:   "MATCH (p:Patient) RETURN p.name, 1.5 AS x",
+		},
+		{
+			name:   "variable length relationship",
+			query:  "MATCH (p:Patient)-[t:TREATS*1..2]-(e:Employee) RETURN p.name",
+			status: analyzer.DecisionAllowed,
+			want:   "MATCH (p:Patient)-[t:TREATS*1..2]-(e:Employee) RETURN p.name",
+		},
+		{
+			name:   "disallowed label",
+			query:  "MATCH (d:Doctor) RETURN d.name",
+			status: analyzer.DecisionBlocked,
+		},
+
+		// Aliases
+		{
+			name:   "allowed property through alias",
+			query:  "MATCH (p:Patient) WITH p AS q RETURN q.name",
+			status: analyzer.DecisionAllowed,
+			want:   "MATCH (p:Patient) WITH p AS q RETURN q.name",
+		},
+		{
+			name:   "disallowed property through alias removed",
+			query:  "MATCH (p:Patient) WITH p AS q RETURN q.name, q.ssn",
+			status: analyzer.DecisionRewritten,
+			want:   "MATCH (p:Patient) WITH p AS q RETURN q.name",
+		},
+		{
+			name:   "disallowed property through alias",
+			query:  "MATCH (p:Patient) WITH p AS q RETURN q.ssn",
+			status: analyzer.DecisionBlocked,
+		},
+		{
+			name:   "disallowed property through unwound list",
+			query:  "MATCH (p:Patient) WITH collect(p) AS ps UNWIND ps AS q RETURN q.ssn",
+			status: analyzer.DecisionBlocked,
+		},
+
+		// Comprehensions
+		{
+			name:   "disallowed property in list comprehension",
+			query:  "MATCH (p:Patient) RETURN [x IN [p] | x.ssn]",
+			status: analyzer.DecisionBlocked,
+		},
+		{
+			name:   "disallowed property in list comprehension predicate",
+			query:  "MATCH (p:Patient) RETURN [x IN [p] WHERE x.ssn = '1' | x.name]",
+			status: analyzer.DecisionBlocked,
+		},
+		{
+			name:   "disallowed property in quantifier",
+			query:  "MATCH (p:Patient) RETURN any(x IN [p] WHERE x.ssn = '1')",
+			status: analyzer.DecisionBlocked,
+		},
+
+		// Properties used outside of RETURN
+		{
+			name:   "disallowed property in WHERE neutralized",
+			query:  "MATCH (p:Patient) WHERE p.ssn = '1' RETURN p.name",
+			status: analyzer.DecisionRewritten,
+			want:   "MATCH (p:Patient) WHERE null = '1' RETURN p.name",
+		},
+		{
+			name:   "disallowed property written",
+			query:  "MATCH (e:Employee) SET e.ssn = '1' RETURN e.name",
+			status: analyzer.DecisionBlocked,
+		},
+		{
+			name:   "disallowed property written from",
+			query:  "MATCH (e:Employee) SET e.name = e.ssn RETURN e.name",
+			status: analyzer.DecisionBlocked,
+		},
+		{
+			name:   "disallowed property in pattern comprehension",
+			query:  "MATCH (e:Employee) RETURN [(e)-[:TREATS]->(p:Patient) | p.ssn]",
+			status: analyzer.DecisionBlocked,
+		},
+
+		// Denied labels
+		{
+			name:   "denied label",
+			query:  "MATCH (s:Secret) RETURN s",
+			status: analyzer.DecisionBlocked,
+		},
+		{
+			name:   "denied label in predicate",
+			query:  "MATCH (p:Patient) WHERE p:Secret RETURN p.name",
+			status: analyzer.DecisionBlocked,
+		},
+		{
+			name:   "denied label next to an allowed label",
+			query:  "MATCH (p:Patient:Secret) RETURN p.name",
+			status: analyzer.DecisionBlocked,
+		},
+		{
+			name:   "disallowed type next to an allowed type",
+			query:  "MATCH (e:Employee)-[r:TREATS|OWNS]->(p:Patient) RETURN p.name",
+			status: analyzer.DecisionBlocked,
+		},
+		{
+			name:   "create of denied label",
+			query:  "CREATE (s:Secret)",
+			status: analyzer.DecisionBlocked,
+		},
+		{
+			name:   "denied label in pattern comprehension",
+			query:  "MATCH (e:Employee) RETURN [(e)-[:TREATS]->(s:Secret) | s.name]",
+			status: analyzer.DecisionBlocked,
+		},
+		{
+			name:   "denied label in pattern predicate",
+			query:  "MATCH (e:Employee) WHERE (e)-[:TREATS]->(:Secret) RETURN e.name",
+			status: analyzer.DecisionBlocked,
+		},
+
+		// Parameters
+		{
+			name:   "allowed parameter map",
+			query:  "MATCH (p:Patient $props) RETURN p.name",
+			params: map[string]any{"props": map[string]any{"name": "x"}},
+			status: analyzer.DecisionAllowed,
+			want:   "MATCH (p:Patient $props) RETURN p.name",
+		},
+		{
+			name:   "disallowed parameter map",
+			query:  "MATCH (p:Patient $props) RETURN p.name",
+			params: map[string]any{"props": map[string]any{"ssn": "1"}},
+			status: analyzer.DecisionBlocked,
+		},
+		{
+			name:   "allowed map key in pattern",
+			query:  "MATCH (p:Patient {name: 'x'}) RETURN p.name",
+			status: analyzer.DecisionAllowed,
+			want:   "MATCH (p:Patient {name: 'x'}) RETURN p.name",
+		},
+		{
+			name:   "disallowed map key in pattern",
+			query:  "MATCH (p:Patient {ssn: '1'}) RETURN p.name",
+			status: analyzer.DecisionBlocked,
+		},
+		{
+			name:   "disallowed map key in relationship pattern",
+			query:  "MATCH (p:Patient)<-[t:TREATS {notes: 'x'}]-(e:Employee) RETURN p.name",
+			status: analyzer.DecisionBlocked,
+		},
+
+		// Operations
+		{
+			name:   "write without update permission",
+			query:  "MATCH (p:Patient) SET p.name = 'x'",
+			status: analyzer.DecisionBlocked,
+		},
+		{
+			name:   "write with update permission",
+			query:  "MATCH (e:Employee) SET e.name = 'x'",
+			status: analyzer.DecisionAllowed,
+			want:   "MATCH (e:Employee) SET e.name = 'x'",
+		},
+		{
+			name:   "write of one label and read of another",
+			query:  "MATCH (p:Patient), (e:Employee) SET e.name = p.name",
+			status: analyzer.DecisionAllowed,
+			want:   "MATCH (p:Patient), (e:Employee) SET e.name = p.name",
+		},
+		{
+			name:   "remove without update permission",
+			query:  "MATCH (p:Patient) REMOVE p.name",
+			status: analyzer.DecisionBlocked,
+		},
+		{
+			name:   "merge without create permission",
+			query:  "MERGE (p:Patient {name: 'x'})",
+			status: analyzer.DecisionBlocked,
+		},
+		{
+			name:   "detach delete without delete permission",
+			query:  "MATCH (e:Employee) DETACH DELETE e",
+			status: analyzer.DecisionBlocked,
+		},
+		{
+			name:   "write through unlabelled variable",
+			query:  "MATCH (n) SET n.name = 'x'",
+			status: analyzer.DecisionBlocked,
+		},
+		{
+			name:   "write through alias",
+			query:  "MATCH (p:Patient) WITH p AS q SET q.name = 'x'",
+			status: analyzer.DecisionBlocked,
+		},
+		{
+			name:   "label added through alias",
+			query:  "MATCH (p:Patient) WITH p AS q SET q:Employee",
+			status: analyzer.DecisionBlocked,
+		},
+
+		// Relationship operations
+		{
+			name:   "create of relationship without create permission",
+			query:  "MATCH (e:Employee), (p:Patient) CREATE (e)-[:TREATS]->(p)",
+			status: analyzer.DecisionBlocked,
+		},
+		{
+			name:   "delete of untyped relationship",
+			query:  "MATCH (p:Patient)-[r]->() DELETE r",
+			status: analyzer.DecisionBlocked,
+		},
+
+		// Dynamic property access
+		{
+			name:   "subscript",
+			query:  "MATCH (p:Patient) RETURN p['ssn']",
+			status: analyzer.DecisionBlocked,
+		},
+		{
+			name:   "properties function",
+			query:  "MATCH (p:Patient) RETURN properties(p)",
+			status: analyzer.DecisionBlocked,
+		},
+		{
+			name:   "keys function",
+			query:  "MATCH (p:Patient) RETURN keys(p)",
+			status: analyzer.DecisionBlocked,
+		},
+		{
+			name:   "list literal",
+			query:  "MATCH (p:Patient) WHERE p.name IN ['a', 'b'] RETURN p.name",
+			status: analyzer.DecisionAllowed,
+			want:   "MATCH (p:Patient) WHERE p.name IN ['a', 'b'] RETURN p.name",
+		},
+
+		// Procedures and functions
+		{
+			name:   "procedure call",
+			query:  "CALL db.labels()",
+			status: analyzer.DecisionBlocked,
+		},
+		{
+			name:   "namespaced function",
+			query:  "MATCH (p:Patient) RETURN apoc.text.join([p.name], ',')",
+			status: analyzer.DecisionBlocked,
+		},
+
+		// Escaped names and comments
+		{
+			name:   "quoted disallowed property removed",
+			query:  "MATCH (p:Patient) RETURN p.name, p.`ssn`",
+			status: analyzer.DecisionRewritten,
+			want:   "MATCH (p:Patient) RETURN p.name",
+		},
+		{
+			name:   "quoted denied label",
+			query:  "MATCH (s:`Secret`) RETURN s",
+			status: analyzer.DecisionBlocked,
+		},
+		{
+			name:   "denied label after comment",
+			query:  "MATCH (s:/* label */Secret) RETURN s",
+			status: analyzer.DecisionBlocked,
+		},
+		{
+			name:   "escaped denied label",
+			query:  "MATCH (s:`Sec\\u0072et`) RETURN s",
+			status: analyzer.DecisionBlocked,
+		},
+
+		// Clause keywords
+		{
+			name:   "keyword in string literal",
+			query:  "MATCH (p:Patient) WHERE p.name = 'SET x' RETURN p.name",
+			status: analyzer.DecisionAllowed,
+			want:   "MATCH (p:Patient) WHERE p.name = 'SET x' RETURN p.name",
+		},
+		{
+			name:   "keyword as alias",
+			query:  "MATCH (p:Patient) RETURN p.name AS delete",
+			status: analyzer.DecisionAllowed,
+			want:   "MATCH (p:Patient) RETURN p.name AS delete",
+		},
+		{
+			name:   "keyword as variable",
+			query:  "MATCH (set:Patient) RETURN set.name",
+			status: analyzer.DecisionAllowed,
+			want:   "MATCH (set:Patient) RETURN set.name",
+		},
+		{
+			name:   "keyword alias returned",
+			query:  "MATCH (p:Patient) WITH p.name AS delete RETURN delete",
+			status: analyzer.DecisionAllowed,
+			want:   "MATCH (p:Patient) WITH p.name AS delete RETURN delete",
+		},
+		{
+			name:   "keyword after comment",
+			query:  "MATCH (p:Patient) /* x */SET p.name = 'x'",
+			status: analyzer.DecisionBlocked,
+		},
+	}
+
+	p := New(nil)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			decision, err := p.Analyze(context.Background(), tt.query, tt.params, &analyzer.Principal{Permissions: analyzertest.Permissions()})
+			if err != nil {
+				t.Fatalf("Analyze(%q) failed: %v", tt.query, err)
+			}
+			if decision.Status != tt.status {
+				t.Errorf("Analyze(%q) status = %s, want %s", tt.query, decision.Status, tt.status)
+			}
+			if decision.Query != tt.want {
+				t.Errorf("Analyze(%q) query = %q, want %q", tt.query, decision.Query, tt.want)
+			}
+			if decision.Status == analyzer.DecisionAllowed && len(decision.Violations) > 0 {
+				t.Errorf("Analyze(%q) is allowed with violations %v", tt.query, decision.Violations)
+			}
+		})
+	}
+}
+
+func TestAnalyzeNotProperties(t *testing.T) {
+	queries := []string{
+		"MATCH (p:Patient) RETURN p.name, 1.5 AS x",
+		"MATCH (p:Patient)-[t:TREATS*1..2]-(e:Employee) RETURN p.name",
+		"CALL db.labels()",
+	}
+
+	for _, query := range queries {
+		t.Run(query, func(t *testing.T) {
+			decision, err := New(nil).Analyze(context.Background(), query, nil, &analyzer.Principal{Permissions: analyzertest.Permissions()})
+			if err != nil {
+				t.Fatalf("Analyze failed: %v", err)
+			}
+			for _, v := range decision.Violations {
+				if v.Kind == analyzer.ViolationProperty {
+					t.Errorf("Analyze(%q) reported property '%s'", query, v.Property)
+				}
+			}
+		})
+	}
+}
+
+func TestAnalyzeRowFilters(t *testing.T) {
+	perm := analyzertest.Permissions()
+	perm.RowFilters = map[string][]string{"Patient": {"n.ward = $user.ward"}}
+	perm.RelationshipRowFilters = map[string][]string{"TREATS": {"n.active"}}
+
+	tests := []struct {
+		name   string
+		query  string
+		status analyzer.DecisionStatus
+	}{
+		{name: "unfiltered label", query: "MATCH (e:Employee) RETURN count(e)", status: analyzer.DecisionAllowed},
+		{name: "filtered label", query: "MATCH (p:Patient) RETURN p.name", status: analyzer.DecisionBlocked},
+		{name: "filtered relationship type", query: "MATCH (e:Employee)-[:TREATS]->(x:Employee) RETURN x.name", status: analyzer.DecisionBlocked},
+		{name: "unlabelled node", query: "MATCH (n) RETURN n.name", status: analyzer.DecisionBlocked},
+		{name: "untyped relationship", query: "MATCH (e:Employee)-->(x:Employee) RETURN x.name", status: analyzer.DecisionBlocked},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			decision, err := New(nil).Analyze(context.Background(), tt.query, nil, &analyzer.Principal{Permissions: perm})
+			if err != nil {
+				t.Fatalf("Analyze failed: %v", err)
+			}
+			if decision.Status != tt.status {
+				t.Errorf("Analyze(%q) status = %s, want %s", tt.query, decision.Status, tt.status)
+			}
+		})
+	}
+}
@@ -0,0 +1,51 @@
+package analyzer
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/antlr4-go/antlr/v4"
+)
+
+// A single syntax error reported while lexing or parsing a query
+type SyntaxErrorDetail struct {
+	Line    int    `json:"line"`
+	Column  int    `json:"column"`
+	Message string `json:"message"`
+}
+
+// Returned when a query cannot be fully parsed
+// Analysis never continues on a partial parse-tree, as it could miss parts of the query
+type SyntaxError struct {
+	Errors []SyntaxErrorDetail
+}
+
+func (e *SyntaxError) Error() string {
+	messages := make([]string, len(e.Errors))
+	for i, detail := range e.Errors {
+		messages[i] = fmt.Sprintf("line %d:%d %s", detail.Line, detail.Column, detail.Message)
+	}
+	return "Invalid Cypher syntax: " + strings.Join(messages, ", ")
+}
+
+// Collects the syntax errors reported by an ANTLR lexer or parser instead of printing them to the console
+type SyntaxErrorListener struct {
+	*antlr.DefaultErrorListener
+	Errors []SyntaxErrorDetail
+}
+
+func NewSyntaxErrorListener() *SyntaxErrorListener {
+	return &SyntaxErrorListener{DefaultErrorListener: antlr.NewDefaultErrorListener()}
+}
+
+func (l *SyntaxErrorListener) SyntaxError(_ antlr.Recognizer, _ interface{}, line, column int, msg string, _ antlr.RecognitionException) {
+	l.Errors = append(l.Errors, SyntaxErrorDetail{Line: line, Column: column, Message: msg})
+}
+
+// Returns the collected errors as a SyntaxError, or nil if there were none
+func (l *SyntaxErrorListener) Err() error {
+	if len(l.Errors) == 0 {
+		return nil
+	}
+	return &SyntaxError{Errors: l.Errors}
+}
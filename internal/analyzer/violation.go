@@ -0,0 +1,79 @@
+package analyzer
+
+import (
+	"strings"
+	"unicode/utf8"
+
+	"github.com/antlr4-go/antlr/v4"
+)
+
+// The kind of rule a violation is about
+type ViolationKind string
+
+const (
+	ViolationLabel        ViolationKind = "label"
+	ViolationRelationship ViolationKind = "relationship"
+	ViolationProperty     ViolationKind = "property"
+	ViolationOperation    ViolationKind = "operation"
+	ViolationRowFilter    ViolationKind = "row_filter"     // A row filter was applied, or could not be
+	ViolationConstraint   ViolationKind = "constraint"     // An unlabelled node or untyped relationship was constrained
+	ViolationMapKey       ViolationKind = "map_key"        // A map used as pattern properties matches a disallowed property
+	ViolationWrite        ViolationKind = "write"          // A property is written without a write grant
+	ViolationDynamic      ViolationKind = "dynamic_access" // Properties are read without a property lookup, e.g. properties(n) or n[$key]
+	ViolationProcedure    ViolationKind = "procedure"
+	ViolationFunction     ViolationKind = "function"
+)
+
+// The part of the query a violation was found in
+// Start and End are character offsets, Line is 1-based and Column is 0-based, as in SyntaxErrorDetail
+type Span struct {
+	Start  int `json:"start"`
+	End    int `json:"end"`
+	Line   int `json:"line"`
+	Column int `json:"column"`
+}
+
+// A single reason a query was blocked or rewritten, with the permission that decided it as RuleID
+type Violation struct {
+	Kind      ViolationKind `json:"kind"`
+	Entity    string        `json:"entity,omitempty"`
+	Property  string        `json:"property,omitempty"`
+	Variable  string        `json:"variable,omitempty"`
+	Operation string        `json:"operation,omitempty"`
+	Span      *Span         `json:"span,omitempty"`
+	RuleID    string        `json:"ruleId,omitempty"`
+	Message   string        `json:"message"`
+	// The analyzer cannot check the rule, so it blocks the query without a verdict on whether the rule allows it
+	Unsupported bool `json:"unsupported,omitempty"`
+}
+
+func (v Violation) String() string {
+	return v.Message
+}
+
+// Joins the messages of the violations, e.g. for a rewrite reason
+func JoinViolations(violations []Violation, sep string) string {
+	messages := make([]string, len(violations))
+	for i, v := range violations {
+		messages[i] = v.Message
+	}
+	return strings.Join(messages, sep)
+}
+
+// Returns the span of a parse-tree node
+func SpanOf(ctx antlr.ParserRuleContext) *Span {
+	start, stop := ctx.GetStart(), ctx.GetStop()
+	if start == nil || stop == nil {
+		return nil
+	}
+	return &Span{Start: start.GetStart(), End: stop.GetStop() + 1, Line: start.GetLine(), Column: start.GetColumn()}
+}
+
+// Returns the span of the byte range [start, end) in the query text, e.g. a regexp match
+func SpanAt(text string, start, end int) *Span {
+	before := text[:start]
+	line := 1 + strings.Count(before, "\n")
+	column := utf8.RuneCountInString(before[strings.LastIndex(before, "\n")+1:])
+	offset := utf8.RuneCountInString(before)
+	return &Span{Start: offset, End: offset + utf8.RuneCountInString(text[start:end]), Line: line, Column: column}
+}
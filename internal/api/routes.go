@@ -4,22 +4,55 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"log"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/danielbahrami/se10-mt/internal/analyzer"
 	"github.com/danielbahrami/se10-mt/internal/postgres"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
+type QueryPayload struct {
+	Cypher     string         `json:"cypher"`
+	Parameters map[string]any `json:"parameters,omitempty"`
+}
+
 type QueryResponse struct {
-	Data          []map[string]any `json:"data"`
-	Rewritten     bool             `json:"rewritten"`
-	RewriteReason string           `json:"rewriteReason,omitempty"`
+	Data          []map[string]any     `json:"data"`
+	Rewritten     bool                 `json:"rewritten"`
+	RewriteReason string               `json:"rewriteReason,omitempty"`
+	Violations    []analyzer.Violation `json:"violations,omitempty"`
+}
+
+type ForbiddenResponse struct {
+	Error      string               `json:"error"`
+	Violations []analyzer.Violation `json:"violations"`
+}
+
+type ExplainResponse struct {
+	AnalyzerMode   string                  `json:"analyzerMode"`
+	Decision       analyzer.DecisionStatus `json:"decision"`
+	RewrittenQuery string                  `json:"rewrittenQuery,omitempty"`
+	Violations     []analyzer.Violation    `json:"violations"`
+	Labels         []string                `json:"labels"`
+	Relationships  []string                `json:"relationships"`
+	Properties     []string                `json:"properties"`
+	Trace          []string                `json:"trace"`
+}
+
+type SyntaxErrorResponse struct {
+	Error        string                       `json:"error"`
+	SyntaxErrors []analyzer.SyntaxErrorDetail `json:"syntaxErrors"`
 }
 
-func SetupRoutes(mux *http.ServeMux, dbpool *pgxpool.Pool, regexAnalyzer analyzer.Analyzer, parserAnalyzer analyzer.Analyzer) {
+// The analyzers a client can select with the Analyzer-Mode header, keyed by mode
+// Which of them a user may select is set by their organization's analyzer policy
+type Analyzers map[string]analyzer.Analyzer
+
+func SetupRoutes(mux *http.ServeMux, dbpool *pgxpool.Pool, analyzers Analyzers) {
 	// Health endpoint
 	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodGet {
@@ -32,99 +65,265 @@ func SetupRoutes(mux *http.ServeMux, dbpool *pgxpool.Pool, regexAnalyzer analyze
 
 	// Query endpoint
 	mux.HandleFunc("/query", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodPost {
-			http.Error(w, "", http.StatusMethodNotAllowed)
+		req, ok := parseQueryRequest(w, r, dbpool, analyzers)
+		if !ok {
 			return
 		}
+		user, payload, principal, activeAnalyzer := req.user, req.payload, req.principal, req.analyzer
 
-		// Authenticate user
-		user, err := AuthenticateUser(r, dbpool)
+		// Analyze the Cypher query for the user
+		decision, err := activeAnalyzer.Analyze(r.Context(), payload.Cypher, payload.Parameters, principal)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusUnauthorized)
+			writeAnalyzeError(w, err)
 			return
 		}
 
-		// Decode JSON payload body
-		var payload struct {
-			Cypher string `json:"cypher"`
+		rewrittenQuery := ""
+		if decision.Status == analyzer.DecisionRewritten {
+			rewrittenQuery = decision.Query
 		}
 
-		decoder := json.NewDecoder(r.Body)
-		if err := decoder.Decode(&payload); err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+		if decision.Status == analyzer.DecisionBlocked {
+			logQuery(dbpool, user, payload.Cypher, decision.Status, rewrittenQuery, decision.Violations)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(ForbiddenResponse{Error: analyzer.JoinViolations(decision.Violations, ", "), Violations: decision.Violations})
 			return
 		}
 
-		if payload.Cypher == "" {
-			http.Error(w, "The 'cypher' field is required", http.StatusBadRequest)
-			return
-		}
-
-		// Retrieve user permissions
-		perm, err := postgres.GetUserPermissions(r.Context(), dbpool, user)
+		// Execute the allowed or rewritten query, until the client disconnects or the organization's timeout passes
+		org, err := postgres.GetOrganizationById(r.Context(), dbpool, user.OrgID)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
-		// Select analyzer based on header
-		mode := r.Header.Get("Analyzer-Mode")
-		var activeAnalyzer analyzer.Analyzer
+		ctx := r.Context()
+		if org.QueryTimeoutMs > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, time.Duration(org.QueryTimeoutMs)*time.Millisecond)
+			defer cancel()
+		}
 
-		switch mode {
-		case "regex":
-			activeAnalyzer = regexAnalyzer
-		case "parser":
-			activeAnalyzer = parserAnalyzer
-		case "":
-			http.Error(w, "Missing analyzer-mode header", http.StatusBadRequest)
-			return
-		default:
-			http.Error(w, "Invalid analyzer-mode header (must be 'regex' or 'parser')", http.StatusBadRequest)
+		results, err := activeAnalyzer.Execute(ctx, decision, principal)
+		if err != nil && ctx.Err() != nil {
+			log.Println("Query cancelled:", ctx.Err())
+			logQuery(dbpool, user, payload.Cypher, analyzer.DecisionCancelled, rewrittenQuery, decision.Violations)
+			http.Error(w, "Query cancelled: "+ctx.Err().Error(), http.StatusGatewayTimeout)
 			return
 		}
 
-		// Provide the Cypher query and the user's permissions to the analyzer
-		results, wasRewritten, rewrittenQuery, violations, err := activeAnalyzer.AnalyzeAndExecute(payload.Cypher, perm)
+		logQuery(dbpool, user, payload.Cypher, decision.Status, rewrittenQuery, decision.Violations)
 		if err != nil {
-			if errors.Is(err, analyzer.ForbiddenQueryErr) {
-				go func(pool *pgxpool.Pool, userID int, query, status, rewritten string) {
-					if err := postgres.LogQuery(context.Background(), pool, userID, query, status, rewritten); err != nil {
-						log.Println(err.Error())
-					}
-				}(dbpool, user.ID, payload.Cypher, "Blocked", "")
-
-				http.Error(w, strings.Join(violations, ", "), http.StatusForbidden)
-				return
-			}
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 
 		response := QueryResponse{
 			Data:          results,
-			Rewritten:     wasRewritten,
+			Rewritten:     decision.Status == analyzer.DecisionRewritten,
 			RewriteReason: "",
 		}
 
 		// Return the results to the client
-		if wasRewritten {
-			go func(pool *pgxpool.Pool, userID int, query, status, rewritten string) {
-				if err := postgres.LogQuery(context.Background(), pool, userID, query, status, rewritten); err != nil {
-					log.Println(err.Error())
-				}
-			}(dbpool, user.ID, payload.Cypher, "Rewritten", rewrittenQuery)
-
-			response.RewriteReason = strings.Join(violations, ", ")
-		} else {
-			go func(pool *pgxpool.Pool, userID int, query, status, rewritten string) {
-				if err := postgres.LogQuery(context.Background(), pool, userID, query, status, rewritten); err != nil {
-					log.Println(err.Error())
-				}
-			}(dbpool, user.ID, payload.Cypher, "Allowed", "")
+		if response.Rewritten {
+			response.RewriteReason = analyzer.JoinViolations(decision.Violations, ", ")
+			response.Violations = decision.Violations
 		}
 
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(response)
 	})
+
+	// Explain endpoint, which analyzes a query the same way as the query endpoint without executing it
+	mux.HandleFunc("/query/explain", func(w http.ResponseWriter, r *http.Request) {
+		req, ok := parseQueryRequest(w, r, dbpool, analyzers)
+		if !ok {
+			return
+		}
+
+		// Analyzed as a dry run, so consensus mode does not record disagreements for queries that are never executed
+		decision, err := req.analyzer.Analyze(analyzer.WithDryRun(r.Context()), req.payload.Cypher, req.payload.Parameters, req.principal)
+		if err != nil {
+			writeAnalyzeError(w, err)
+			return
+		}
+
+		response := ExplainResponse{
+			AnalyzerMode:  req.mode,
+			Decision:      decision.Status,
+			Violations:    decision.Violations,
+			Labels:        decision.Entities.Labels,
+			Relationships: decision.Entities.Relationships,
+			Properties:    decision.Entities.Properties,
+			Trace:         decision.Trace,
+		}
+		if decision.Status == analyzer.DecisionRewritten {
+			response.RewrittenQuery = decision.Query
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	})
+
+	// Log verification endpoint, which walks the hash chain of the user's organization's audit log
+	mux.HandleFunc("/logs/verify", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "", http.StatusMethodNotAllowed)
+			return
+		}
+
+		user, err := AuthenticateUser(r, dbpool)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		result, err := postgres.VerifyLogs(r.Context(), dbpool, user.OrgID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
+	})
+}
+
+// The parts of a request shared by the query and explain endpoints
+type queryRequest struct {
+	user      *postgres.User
+	payload   QueryPayload
+	principal *analyzer.Principal
+	mode      string
+	analyzer  analyzer.Analyzer
+}
+
+// Authenticates the user, decodes the payload, loads the user's permissions and attributes and selects the analyzer
+// permitted by the user's analyzer policy
+// On failure the error response has been written and false is returned
+func parseQueryRequest(w http.ResponseWriter, r *http.Request, dbpool *pgxpool.Pool, analyzers Analyzers) (*queryRequest, bool) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "", http.StatusMethodNotAllowed)
+		return nil, false
+	}
+
+	// Authenticate user
+	user, err := AuthenticateUser(r, dbpool)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return nil, false
+	}
+
+	// Decode JSON payload body
+	var payload QueryPayload
+	decoder := json.NewDecoder(r.Body)
+	decoder.UseNumber()
+	if err := decoder.Decode(&payload); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+
+	if payload.Cypher == "" {
+		http.Error(w, "The 'cypher' field is required", http.StatusBadRequest)
+		return nil, false
+	}
+
+	// The user parameter holds the user's attributes in rewritten queries, so clients cannot set it
+	if _, ok := payload.Parameters[analyzer.UserParameter]; ok {
+		http.Error(w, "The '"+analyzer.UserParameter+"' parameter is reserved", http.StatusBadRequest)
+		return nil, false
+	}
+	payload.Parameters = normalizeParameters(payload.Parameters).(map[string]any)
+
+	// Retrieve user permissions
+	perm, err := postgres.GetUserPermissions(r.Context(), dbpool, user)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, false
+	}
+
+	// Retrieve user attributes, which are bound as parameters of rewritten queries
+	attributes, err := postgres.GetUserAttributes(r.Context(), dbpool, user.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, false
+	}
+
+	// Select the analyzer from the header, among the modes the user's organization permits, or use the default mode
+	policy, err := postgres.GetAnalyzerPolicy(r.Context(), dbpool, user)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, false
+	}
+	if len(policy.Modes) == 0 {
+		http.Error(w, "No analyzer mode is permitted for this user", http.StatusForbidden)
+		return nil, false
+	}
+	mode := r.Header.Get("Analyzer-Mode")
+	if mode == "" {
+		mode = policy.Default
+	}
+	activeAnalyzer, ok := analyzers[mode]
+	if !ok {
+		http.Error(w, "Invalid analyzer-mode header (must be 'regex', 'parser' or 'consensus')", http.StatusBadRequest)
+		return nil, false
+	}
+	if !policy.Allows(mode) {
+		http.Error(w, fmt.Sprintf("Analyzer mode '%s' is not permitted (allowed: %s)", mode, strings.Join(policy.Modes, ", ")), http.StatusForbidden)
+		return nil, false
+	}
+
+	principal := &analyzer.Principal{UserID: user.ID, OrgID: user.OrgID, Permissions: perm, Attributes: attributes}
+	return &queryRequest{user: user, payload: payload, principal: principal, mode: mode, analyzer: activeAnalyzer}, true
+}
+
+// Converts JSON numbers in the parameters to int64 when they are integers and float64 otherwise,
+// as Neo4j distinguishes integers from floats, e.g. in SKIP and LIMIT
+func normalizeParameters(value any) any {
+	switch v := value.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]any:
+		normalized := make(map[string]any, len(v))
+		for k, item := range v {
+			normalized[k] = normalizeParameters(item)
+		}
+		return normalized
+	case []any:
+		normalized := make([]any, len(v))
+		for i, item := range v {
+			normalized[i] = normalizeParameters(item)
+		}
+		return normalized
+	default:
+		return value
+	}
+}
+
+// Writes the response for a query that could not be analyzed
+func writeAnalyzeError(w http.ResponseWriter, err error) {
+	// Reject queries that could not be fully parsed, listing every syntax error
+	var syntaxErr *analyzer.SyntaxError
+	if errors.As(err, &syntaxErr) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(SyntaxErrorResponse{Error: "Invalid Cypher syntax", SyntaxErrors: syntaxErr.Errors})
+		return
+	}
+	http.Error(w, err.Error(), http.StatusBadRequest)
+}
+
+// Records the decision for a query in the audit log without blocking the response
+// The log entry is written with its own context, so it is kept even if the request is cancelled
+func logQuery(dbpool *pgxpool.Pool, user *postgres.User, query string, status analyzer.DecisionStatus, rewritten string, violations []analyzer.Violation) {
+	go func() {
+		if err := postgres.LogQuery(context.Background(), dbpool, user.OrgID, user.ID, query, string(status), rewritten, violations); err != nil {
+			log.Println(err.Error())
+		}
+	}()
 }
@@ -34,15 +34,18 @@ func ConnectNeo4j(ctx context.Context) (neo4j.DriverWithContext, error) {
 func QueryHandler(
 	ctx context.Context,
 	driver neo4j.DriverWithContext,
-	cypher string) ([]QueryResult, error) {
-	parameters := map[string]any{}
+	cypher string,
+	parameters map[string]any) ([]QueryResult, error) {
+	if parameters == nil {
+		parameters = map[string]any{}
+	}
 	result, err := neo4j.ExecuteQuery(ctx, driver,
 		cypher,
 		parameters,
 		neo4j.EagerResultTransformer,
 		neo4j.ExecuteQueryWithDatabase("neo4j"))
 	if err != nil {
-		return nil, fmt.Errorf("%s", err.Error())
+		return nil, fmt.Errorf("run query: %w", err)
 	}
 
 	var records []QueryResult
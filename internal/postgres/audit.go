@@ -0,0 +1,143 @@
+package postgres
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// The previous hash of an organization's first log entry
+var GenesisHash = strings.Repeat("0", 64)
+
+// The advisory lock class held while appending to a log chain, the second key is the organization
+const logChainLock = 0x6c6f6773
+
+// The result of walking an organization's log chain
+// Head is the hash of the last entry, which can be recorded elsewhere to detect entries removed from the end of the chain
+type LogChainVerification struct {
+	OrgID      int         `json:"orgId"`
+	Entries    int         `json:"entries"`
+	Valid      bool        `json:"valid"`
+	Head       string      `json:"head,omitempty"`
+	BrokenLink *BrokenLink `json:"brokenLink,omitempty"`
+}
+
+// The first log entry whose hashes do not match the chain
+type BrokenLink struct {
+	LogID  int    `json:"logId"`
+	Reason string `json:"reason"`
+}
+
+// Returns the hash of the entry's contents and its PrevHash, as a hex string
+// Every field is length prefixed, so moving text from one field to another changes the hash
+func hashLog(entry *Log) (string, error) {
+	violations, err := canonicalJSON(entry.Violations)
+	if err != nil {
+		return "", err
+	}
+
+	h := sha256.New()
+	for _, field := range []string{
+		entry.PrevHash,
+		strconv.Itoa(entry.OrgID),
+		strconv.Itoa(entry.UserID),
+		entry.Query,
+		entry.Decision,
+		entry.RewrittenQuery,
+		violations,
+		entry.CreatedAt.UTC().Format(time.RFC3339Nano),
+	} {
+		fmt.Fprintf(h, "%d:%s\n", len(field), field)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Re-encodes JSON so that the JSON a log entry was written with and the JSONB it is read back as hash the same
+func canonicalJSON(raw string) (string, error) {
+	var value any
+	if err := json.Unmarshal([]byte(raw), &value); err != nil {
+		return "", fmt.Errorf("%s", err.Error())
+	}
+	canonical, err := json.Marshal(value)
+	if err != nil {
+		return "", fmt.Errorf("%s", err.Error())
+	}
+	return string(canonical), nil
+}
+
+// Walks the organization's log chain in order and reports the first entry that was edited, or whose predecessor
+// was deleted or reordered
+func VerifyLogs(ctx context.Context, dbpool *pgxpool.Pool, orgId int) (*LogChainVerification, error) {
+	sql := `
+        SELECT id, org_id, user_id, query, decision, COALESCE(rewritten_query, ''), COALESCE(violations::text, 'null'), created_at, prev_hash, hash
+        FROM logs WHERE org_id = $1 ORDER BY id
+	`
+	rows, err := dbpool.Query(ctx, sql, orgId)
+	if err != nil {
+		return nil, fmt.Errorf("%s", err.Error())
+	}
+	defer rows.Close()
+
+	result := &LogChainVerification{OrgID: orgId, Valid: true}
+	prevHash := GenesisHash
+	for rows.Next() {
+		var entry Log
+		err := rows.Scan(&entry.ID, &entry.OrgID, &entry.UserID, &entry.Query, &entry.Decision, &entry.RewrittenQuery, &entry.Violations, &entry.CreatedAt, &entry.PrevHash, &entry.Hash)
+		if err != nil {
+			return nil, fmt.Errorf("%s", err.Error())
+		}
+		result.Entries++
+
+		if entry.PrevHash != prevHash {
+			result.Valid = false
+			result.BrokenLink = &BrokenLink{LogID: entry.ID, Reason: "previous hash does not match the preceding entry, which was edited, deleted or reordered"}
+			return result, nil
+		}
+		hash, err := hashLog(&entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid violations in log %d: %s", entry.ID, err.Error())
+		}
+		if entry.Hash != hash {
+			result.Valid = false
+			result.BrokenLink = &BrokenLink{LogID: entry.ID, Reason: "hash does not match the entry's contents, which were edited"}
+			return result, nil
+		}
+		prevHash = entry.Hash
+		result.Head = entry.Hash
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("%s", err.Error())
+	}
+
+	return result, nil
+}
+
+// Returns the IDs of every organization
+func GetOrganizationIds(ctx context.Context, dbpool *pgxpool.Pool) ([]int, error) {
+	rows, err := dbpool.Query(ctx, "SELECT id FROM organizations ORDER BY id")
+	if err != nil {
+		return nil, fmt.Errorf("%s", err.Error())
+	}
+	defer rows.Close()
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("%s", err.Error())
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("%s", err.Error())
+	}
+
+	return ids, nil
+}
@@ -0,0 +1,46 @@
+package postgres
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHashLog(t *testing.T) {
+	entry := Log{
+		OrgID:      1,
+		UserID:     2,
+		Query:      "MATCH (p:Patient) RETURN p.name",
+		Decision:   "Allowed",
+		Violations: `[{"kind": "label", "message": "x"}]`,
+		CreatedAt:  time.Date(2026, 1, 2, 3, 4, 5, 6, time.UTC),
+		PrevHash:   GenesisHash,
+	}
+	hash, err := hashLog(&entry)
+	if err != nil {
+		t.Fatalf("hashLog failed: %v", err)
+	}
+
+	// JSONB normalizes whitespace and key order, which must not change the hash
+	same := entry
+	same.Violations = `[{"message":"x","kind":"label"}]`
+	same.CreatedAt = entry.CreatedAt.In(time.FixedZone("CET", 3600))
+	if got, _ := hashLog(&same); got != hash {
+		t.Errorf("hashLog of the same entry read back from the database = %s, want %s", got, hash)
+	}
+
+	edits := map[string]func(*Log){
+		"query":     func(l *Log) { l.Query += " LIMIT 1" },
+		"decision":  func(l *Log) { l.Decision = "Blocked" },
+		"prev hash": func(l *Log) { l.PrevHash = hash },
+		"moved text": func(l *Log) {
+			l.Query, l.RewrittenQuery = "MATCH (p:Patient)", " RETURN p.name"
+		},
+	}
+	for name, edit := range edits {
+		edited := entry
+		edit(&edited)
+		if got, _ := hashLog(&edited); got == hash {
+			t.Errorf("hashLog after editing the %s did not change", name)
+		}
+	}
+}
@@ -3,6 +3,10 @@ CREATE TABLE organizations (
     id SERIAL PRIMARY KEY,
     name VARCHAR(50) NOT NULL,
     default_permissions JSONB NOT NULL,
+    query_timeout_ms INT NOT NULL DEFAULT 30000 CHECK (query_timeout_ms >= 0),
+    -- The analyzer modes users may select with the Analyzer-Mode header, and the mode used when they select none
+    analyzer_modes TEXT[] NOT NULL DEFAULT ARRAY['parser', 'consensus'] CHECK (analyzer_modes <@ ARRAY['regex', 'parser', 'consensus']),
+    default_analyzer_mode VARCHAR(10) NOT NULL DEFAULT 'parser' CHECK (default_analyzer_mode = ANY (analyzer_modes)),
     created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
     updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
 );
@@ -14,16 +18,70 @@ CREATE TABLE users (
     email VARCHAR(100) NOT NULL UNIQUE,
     hashed_bearer_token TEXT NOT NULL,
     override_permissions JSONB,
+    -- Narrows the organization's analyzer modes and overrides its default for this user
+    analyzer_modes TEXT[] CHECK (analyzer_modes <@ ARRAY['regex', 'parser', 'consensus']),
+    default_analyzer_mode VARCHAR(10) CHECK (default_analyzer_mode IN ('regex', 'parser', 'consensus')),
     created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
     updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
 );
 
+CREATE TABLE user_attributes (
+    id SERIAL PRIMARY KEY,
+    user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    key VARCHAR(50) NOT NULL,
+    value TEXT NOT NULL,
+    value_type VARCHAR(10) NOT NULL CHECK (value_type IN ('string', 'integer', 'float', 'boolean')),
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    UNIQUE (user_id, key)
+);
+
+CREATE TABLE roles (
+    id SERIAL PRIMARY KEY,
+    org_id INT NOT NULL REFERENCES organizations(id),
+    name VARCHAR(50) NOT NULL,
+    permissions JSONB NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    UNIQUE (org_id, name)
+);
+
+CREATE TABLE user_roles (
+    user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    role_id INT NOT NULL REFERENCES roles(id) ON DELETE CASCADE,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (user_id, role_id)
+);
+
+-- Each organization's entries form a hash chain: hash covers the entry's contents and prev_hash,
+-- which is the hash of the organization's previous entry, so editing or deleting an entry breaks the chain
 CREATE TABLE logs (
     id SERIAL PRIMARY KEY,
+    org_id INT NOT NULL REFERENCES organizations(id),
     user_id INT NOT NULL REFERENCES users(id),
     query TEXT NOT NULL,
-    decision VARCHAR(10) NOT NULL CHECK (decision IN ('Allowed', 'Blocked', 'Rewritten')),
+    decision VARCHAR(10) NOT NULL CHECK (decision IN ('Allowed', 'Blocked', 'Rewritten', 'Cancelled')),
     rewritten_query TEXT,
+    violations JSONB,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    prev_hash CHAR(64) NOT NULL,
+    hash CHAR(64) NOT NULL UNIQUE
+);
+
+CREATE INDEX logs_org_id_idx ON logs (org_id, id);
+
+-- Queries the regex and parser analyzers reached different decisions, rewrites or violations on in consensus mode
+CREATE TABLE analyzer_disagreements (
+    id SERIAL PRIMARY KEY,
+    org_id INT NOT NULL REFERENCES organizations(id),
+    user_id INT NOT NULL REFERENCES users(id),
+    query TEXT NOT NULL,
+    regex_decision VARCHAR(10) NOT NULL CHECK (regex_decision IN ('Allowed', 'Blocked', 'Rewritten')),
+    parser_decision VARCHAR(10) NOT NULL CHECK (parser_decision IN ('Allowed', 'Blocked', 'Rewritten')),
+    regex_rewritten_query TEXT,
+    parser_rewritten_query TEXT,
+    regex_violations JSONB,
+    parser_violations JSONB,
     created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
 );
 
@@ -47,3 +105,15 @@ CREATE TRIGGER update_users_updated_at
 BEFORE UPDATE ON users
 FOR EACH ROW
 EXECUTE PROCEDURE update_updated_at_column();
+
+-- Attach trigger to user_attributes table
+CREATE TRIGGER update_user_attributes_updated_at
+BEFORE UPDATE ON user_attributes
+FOR EACH ROW
+EXECUTE PROCEDURE update_updated_at_column();
+
+-- Attach trigger to roles table
+CREATE TRIGGER update_roles_updated_at
+BEFORE UPDATE ON roles
+FOR EACH ROW
+EXECUTE PROCEDURE update_updated_at_column();
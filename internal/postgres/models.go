@@ -6,11 +6,14 @@ import (
 )
 
 type Organization struct {
-	ID                 int
-	Name               string
-	DefaultPermissions string
-	CreatedAt          time.Time
-	UpdatedAt          time.Time
+	ID                  int
+	Name                string
+	DefaultPermissions  string
+	QueryTimeoutMs      int      // How long a query may run in Neo4j, 0 means no limit
+	AnalyzerModes       []string // The analyzer modes users may select, e.g. "parser" or "consensus"
+	DefaultAnalyzerMode string   // The analyzer mode used when a user selects none
+	CreatedAt           time.Time
+	UpdatedAt           time.Time
 }
 
 type User struct {
@@ -20,17 +23,66 @@ type User struct {
 	Email               string
 	HashedBearerToken   string
 	OverridePermissions sql.NullString
+	AnalyzerModes       []string       // Narrows the organization's analyzer modes, nil means no restriction
+	DefaultAnalyzerMode sql.NullString // Overrides the organization's default analyzer mode
 	CreatedAt           time.Time
 	UpdatedAt           time.Time
 }
 
+// The analyzer modes a user may select with the Analyzer-Mode header, and the mode used when they select none
+type AnalyzerPolicy struct {
+	Modes   []string
+	Default string
+}
+
+// A named set of permissions within an organization, which users are granted through user_roles
+type Role struct {
+	ID          int
+	OrgID       int
+	Name        string
+	Permissions string
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
+
+// A typed key/value fact about a user, such as department or clearance level
+// ValueType is one of "string", "integer", "float" or "boolean"
+type UserAttribute struct {
+	ID        int
+	UserID    int
+	Key       string
+	Value     string
+	ValueType string
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
 type Log struct {
 	ID             int
+	OrgID          int
 	UserID         int
 	Query          string
-	Decision       string // "Allowed", "Blocked", or "Rewritten"
+	Decision       string // "Allowed", "Blocked", "Rewritten", or "Cancelled"
 	RewrittenQuery string
+	Violations     string // JSON array of the violations that caused the decision
 	CreatedAt      time.Time
+	PrevHash       string // Hash of the organization's previous entry, or GenesisHash for its first
+	Hash           string // Hash of this entry's contents and PrevHash
+}
+
+// A query the regex and parser analyzers reached different decisions on
+type AnalyzerDisagreement struct {
+	ID               int
+	OrgID            int
+	UserID           int
+	Query            string
+	RegexDecision    string
+	ParserDecision   string
+	RegexQuery       string // The regex analyzer's rewritten query, empty unless it decided Rewritten
+	ParserQuery      string // The parser analyzer's rewritten query, empty unless it decided Rewritten
+	RegexViolations  string // JSON array of the regex analyzer's violations
+	ParserViolations string // JSON array of the parser analyzer's violations
+	CreatedAt        time.Time
 }
 
 // Defines what CRUD operations are allowed for an entity
@@ -41,14 +93,39 @@ type OperationPermissions struct {
 	Delete bool `json:"delete"`
 }
 
+// How disallowed properties used outside of the RETURN projection (WHERE, ORDER BY, WITH...) are handled
+const (
+	StrictnessStrict  = "strict"  // Block the query
+	StrictnessRewrite = "rewrite" // Replace the property lookups with null
+)
+
 // The overall structure representing the access rules
 // AllowedLabels: The list of node labels a user can access
 // AllowedRelationships: The allowed relationship types
 // AllowedProperties: A mapping from an entity (like a node label) to a list of accessible properties
-// OperationPermissions: Which CRUD operations are permitted for different entities
+// AllowedWriteProperties: A mapping from an entity to the properties that may be written, defaults to AllowedProperties
+// OperationPermissions: Which CRUD operations are permitted for different labels
+// RelationshipOperations: The same for relationship types
+// RowFilters: A mapping from a label to predicates with n as the node and $user as the user (e.g. "n.dept = $user.dept")
+// RelationshipRowFilters: The same for relationship types
+// Strictness: Either "strict" or "rewrite", defaults to "strict"
+// DeniedLabels, DeniedRelationships: Labels and relationship types that are never accessible, even if allowed
+// DeniedProperties: A mapping from an entity to properties that are never accessible, even if allowed
+// AllowedProcedures, AllowedFunctions: Procedures and namespaced functions that may be called (e.g. "apoc.coll.*")
+// Names are matched case-insensitively, and * is the only wildcard
 type Permissions struct {
-	AllowedLabels        []string                        `json:"allowed_labels"`
-	AllowedRelationships []string                        `json:"allowed_relationships"`
-	AllowedProperties    map[string][]string             `json:"allowed_properties"`
-	OperationPermissions map[string]OperationPermissions `json:"operation_permissions,omitempty"`
+	AllowedLabels          []string                        `json:"allowed_labels"`
+	AllowedRelationships   []string                        `json:"allowed_relationships"`
+	AllowedProperties      map[string][]string             `json:"allowed_properties"`
+	AllowedWriteProperties map[string][]string             `json:"allowed_write_properties,omitempty"`
+	OperationPermissions   map[string]OperationPermissions `json:"operation_permissions,omitempty"`
+	RelationshipOperations map[string]OperationPermissions `json:"relationship_operations,omitempty"`
+	RowFilters             map[string][]string             `json:"row_filters,omitempty"`
+	RelationshipRowFilters map[string][]string             `json:"relationship_row_filters,omitempty"`
+	Strictness             string                          `json:"strictness,omitempty"`
+	DeniedLabels           []string                        `json:"denied_labels,omitempty"`
+	DeniedRelationships    []string                        `json:"denied_relationships,omitempty"`
+	DeniedProperties       map[string][]string             `json:"denied_properties,omitempty"`
+	AllowedProcedures      []string                        `json:"allowed_procedures,omitempty"`
+	AllowedFunctions       []string                        `json:"allowed_functions,omitempty"`
 }
@@ -0,0 +1,350 @@
+package postgres
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// Combines the permissions of several roles into the effective permissions of a user
+// Allows and row filters are unioned across roles, while denies and the strict strictness of any role are kept
+func MergePermissions(perms ...*Permissions) *Permissions {
+	merged := &Permissions{
+		AllowedProperties:      make(map[string][]string),
+		AllowedWriteProperties: make(map[string][]string),
+		Strictness:             StrictnessRewrite,
+		DeniedProperties:       make(map[string][]string),
+	}
+	if len(perms) == 0 {
+		merged.Strictness = StrictnessStrict
+		return merged
+	}
+
+	// Keys are compared case-insensitively, keeping the spelling of the first role that uses them
+	names := make(map[string]string)
+	name := func(key string) string {
+		lower := strings.ToLower(key)
+		if _, ok := names[lower]; !ok {
+			names[lower] = key
+		}
+		return names[lower]
+	}
+
+	// Labels and relationship types have operation permissions and row filters of their own
+	labels, relTypes := newGrants(), newGrants()
+
+	for _, perm := range perms {
+		merged.AllowedLabels = union(merged.AllowedLabels, perm.AllowedLabels)
+		merged.AllowedRelationships = union(merged.AllowedRelationships, perm.AllowedRelationships)
+		merged.AllowedProcedures = union(merged.AllowedProcedures, perm.AllowedProcedures)
+		merged.AllowedFunctions = union(merged.AllowedFunctions, perm.AllowedFunctions)
+
+		for entity, props := range perm.AllowedProperties {
+			entity = name(entity)
+			merged.AllowedProperties[entity] = union(merged.AllowedProperties[entity], props)
+		}
+		for entity, props := range perm.WriteProperties() {
+			entity = name(entity)
+			merged.AllowedWriteProperties[entity] = union(merged.AllowedWriteProperties[entity], props)
+		}
+
+		labels.add(perm.AllowedLabels, perm.OperationPermissions, perm.RowFilters, name)
+		relTypes.add(perm.AllowedRelationships, perm.RelationshipOperations, perm.RelationshipRowFilters, name)
+
+		if perm.Strictness != StrictnessRewrite {
+			merged.Strictness = StrictnessStrict
+		}
+
+		merged.DeniedLabels = union(merged.DeniedLabels, perm.DeniedLabels)
+		merged.DeniedRelationships = union(merged.DeniedRelationships, perm.DeniedRelationships)
+		for entity, props := range perm.DeniedProperties {
+			entity = name(entity)
+			merged.DeniedProperties[entity] = union(merged.DeniedProperties[entity], props)
+		}
+	}
+
+	merged.OperationPermissions, merged.RowFilters = labels.merge()
+	merged.RelationshipOperations, merged.RelationshipRowFilters = relTypes.merge()
+
+	return merged
+}
+
+// The operation permissions and row filters of either labels or relationship types across roles
+type grants struct {
+	ops          map[string]OperationPermissions
+	roleFilters  map[string][][]string // Filters per granting role, where nil means the role does not filter the entity
+	unrestricted map[string]bool       // Entities granted by a role without operation permissions for them
+}
+
+func newGrants() *grants {
+	return &grants{
+		ops:          make(map[string]OperationPermissions),
+		roleFilters:  make(map[string][][]string),
+		unrestricted: make(map[string]bool),
+	}
+}
+
+// Adds the operation permissions and row filters of one role, which grants the entities
+func (g *grants) add(entities []string, ops map[string]OperationPermissions, rowFilters map[string][]string, name func(string) string) {
+	for entity, perms := range ops {
+		entity = name(entity)
+		current := g.ops[entity]
+		g.ops[entity] = OperationPermissions{
+			Read:   current.Read || perms.Read,
+			Create: current.Create || perms.Create,
+			Update: current.Update || perms.Update,
+			Delete: current.Delete || perms.Delete,
+		}
+	}
+
+	filters := make(map[string][]string, len(rowFilters))
+	for entity, templates := range rowFilters {
+		filters[strings.ToLower(entity)] = templates
+	}
+	restricted := make(map[string]bool, len(ops))
+	for entity := range ops {
+		restricted[strings.ToLower(entity)] = true
+	}
+	for _, entity := range entities {
+		lower := strings.ToLower(entity)
+		entity = name(entity)
+		g.roleFilters[entity] = append(g.roleFilters[entity], filters[lower])
+		if !restricted[lower] {
+			g.unrestricted[entity] = true
+		}
+	}
+}
+
+// Returns the merged operation permissions and row filters
+func (g *grants) merge() (map[string]OperationPermissions, map[string][]string) {
+	for entity := range g.unrestricted {
+		delete(g.ops, entity)
+	}
+
+	rowFilters := make(map[string][]string)
+	for _, entity := range slices.Sorted(maps.Keys(g.roleFilters)) {
+		if filter := anyOf(g.roleFilters[entity]); filter != "" {
+			rowFilters[entity] = []string{filter}
+		}
+	}
+	return g.ops, rowFilters
+}
+
+// Returns a single filter that holds when all filters of at least one role hold,
+// or an empty string if some role does not filter the entity at all
+func anyOf(roleFilters [][]string) string {
+	var alternatives []string
+	for _, filters := range roleFilters {
+		if len(filters) == 0 {
+			return ""
+		}
+		conditions := make([]string, len(filters))
+		for i, filter := range filters {
+			conditions[i] = "(" + filter + ")"
+		}
+		alternatives = append(alternatives, strings.Join(conditions, " AND "))
+	}
+
+	if len(alternatives) == 1 {
+		return alternatives[0]
+	}
+	for i, alternative := range alternatives {
+		alternatives[i] = "(" + alternative + ")"
+	}
+	return strings.Join(alternatives, " OR ")
+}
+
+// Appends the values that are not in the list yet, ignoring case
+func union(list, values []string) []string {
+	seen := make(map[string]bool, len(list))
+	for _, v := range list {
+		seen[strings.ToLower(v)] = true
+	}
+	for _, v := range values {
+		if !seen[strings.ToLower(v)] {
+			seen[strings.ToLower(v)] = true
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+// Returns the denied_labels rule that matches the label, if any
+func (p *Permissions) DeniedLabel(label string) (string, bool) {
+	return matchRule(p.DeniedLabels, label)
+}
+
+// Returns the denied_relationships rule that matches the relationship type, if any
+func (p *Permissions) DeniedRelationship(relType string) (string, bool) {
+	return matchRule(p.DeniedRelationships, relType)
+}
+
+// Returns the denied_properties rule that matches the property of the entity, written as entity.property
+// An empty entity stands for an unknown entity, which any rule for the property matches
+func (p *Permissions) DeniedProperty(entity, prop string) (string, bool) {
+	for _, ruleEntity := range slices.Sorted(maps.Keys(p.DeniedProperties)) {
+		if entity != "" {
+			if _, ok := matchRule([]string{ruleEntity}, entity); !ok {
+				continue
+			}
+		}
+		if rule, ok := matchRule(p.DeniedProperties[ruleEntity], prop); ok {
+			return ruleEntity + "." + rule, true
+		}
+	}
+	return "", false
+}
+
+// Returns the allowed_procedures rule that matches the procedure, e.g. "apoc.coll.*" for apoc.coll.sum, if any
+func (p *Permissions) AllowedProcedure(name string) (string, bool) {
+	return matchRule(p.AllowedProcedures, name)
+}
+
+// Returns the allowed_functions rule that matches the function, if any
+// Functions without a namespace are built in, such as count or toUpper, and are always allowed
+func (p *Permissions) AllowedFunction(name string) (string, bool) {
+	if !strings.Contains(name, ".") {
+		return name, true
+	}
+	return matchRule(p.AllowedFunctions, name)
+}
+
+// Returns the properties that may be written per entity
+// Permissions without write grants may write the properties they may read
+func (p *Permissions) WriteProperties() map[string][]string {
+	if p.AllowedWriteProperties == nil {
+		return p.AllowedProperties
+	}
+	return p.AllowedWriteProperties
+}
+
+// Returns the allowed labels that are not denied
+func (p *Permissions) EffectiveLabels() []string {
+	var labels []string
+	for _, label := range p.AllowedLabels {
+		if _, denied := p.DeniedLabel(label); !denied {
+			labels = append(labels, label)
+		}
+	}
+	return labels
+}
+
+// Returns the allowed relationship types that are not denied
+func (p *Permissions) EffectiveRelationships() []string {
+	var relTypes []string
+	for _, relType := range p.AllowedRelationships {
+		if _, denied := p.DeniedRelationship(relType); !denied {
+			relTypes = append(relTypes, relType)
+		}
+	}
+	return relTypes
+}
+
+// Reports whether the operation ("read", "create", "update" or "delete") is allowed
+func (o OperationPermissions) Allows(operation string) bool {
+	switch operation {
+	case "read":
+		return o.Read
+	case "create":
+		return o.Create
+	case "update":
+		return o.Update
+	case "delete":
+		return o.Delete
+	}
+	return false
+}
+
+// Returns the first pattern that matches the name, ignoring case
+// Patterns only support the * wildcard, which matches any sequence of characters, and every other character matches itself
+func matchRule(patterns []string, name string) (string, bool) {
+	for _, pattern := range patterns {
+		if matchWildcard(strings.ToLower(pattern), strings.ToLower(name)) {
+			return pattern, true
+		}
+	}
+	return "", false
+}
+
+// Reports whether the name matches the pattern, in which * matches any sequence of characters
+func matchWildcard(pattern, name string) bool {
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return pattern == name
+	}
+	if !strings.HasPrefix(name, parts[0]) {
+		return false
+	}
+	name = name[len(parts[0]):]
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(name, part)
+		if i < 0 {
+			return false
+		}
+		name = name[i+len(part):]
+	}
+	return strings.HasSuffix(name, parts[len(parts)-1])
+}
+
+// Checks that the rules only use the * wildcard
+func (p *Permissions) Validate() error {
+	rules := map[string][]string{
+		"denied_labels":        p.DeniedLabels,
+		"denied_relationships": p.DeniedRelationships,
+		"allowed_procedures":   p.AllowedProcedures,
+		"allowed_functions":    p.AllowedFunctions,
+	}
+	for entity, props := range p.DeniedProperties {
+		rules["denied_properties"] = append(rules["denied_properties"], entity)
+		rules["denied_properties"] = append(rules["denied_properties"], props...)
+	}
+
+	for _, field := range slices.Sorted(maps.Keys(rules)) {
+		for _, rule := range rules[field] {
+			if strings.ContainsAny(rule, `?[]\`) {
+				return fmt.Errorf("invalid rule '%s' in %s: only the * wildcard is supported", rule, field)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Moves operation permissions and row filters keyed by a relationship type into the fields of their own,
+// as configurations stored before those fields existed keyed them alongside the labels
+func (p *Permissions) migrateRelationshipKeys() {
+	labels := make(map[string]bool, len(p.AllowedLabels))
+	for _, label := range p.AllowedLabels {
+		labels[strings.ToLower(label)] = true
+	}
+	relTypes := make(map[string]bool, len(p.AllowedRelationships))
+	for _, relType := range p.AllowedRelationships {
+		if !labels[strings.ToLower(relType)] {
+			relTypes[strings.ToLower(relType)] = true
+		}
+	}
+
+	for entity, ops := range p.OperationPermissions {
+		if !relTypes[strings.ToLower(entity)] {
+			continue
+		}
+		if p.RelationshipOperations == nil {
+			p.RelationshipOperations = make(map[string]OperationPermissions)
+		}
+		if _, ok := p.RelationshipOperations[entity]; !ok {
+			p.RelationshipOperations[entity] = ops
+		}
+		delete(p.OperationPermissions, entity)
+	}
+	for entity, filters := range p.RowFilters {
+		if !relTypes[strings.ToLower(entity)] {
+			continue
+		}
+		if p.RelationshipRowFilters == nil {
+			p.RelationshipRowFilters = make(map[string][]string)
+		}
+		p.RelationshipRowFilters[entity] = append(p.RelationshipRowFilters[entity], filters...)
+		delete(p.RowFilters, entity)
+	}
+}
@@ -0,0 +1,153 @@
+package postgres
+
+import (
+	"reflect"
+	"slices"
+	"testing"
+)
+
+func TestMergePermissions(t *testing.T) {
+	nurse := &Permissions{
+		AllowedLabels:        []string{"Patient"},
+		AllowedProperties:    map[string][]string{"Patient": {"name"}},
+		OperationPermissions: map[string]OperationPermissions{"Patient": {Read: true}},
+		RowFilters:           map[string][]string{"Patient": {"n.ward = $user.ward"}},
+		Strictness:           StrictnessRewrite,
+	}
+	doctor := &Permissions{
+		AllowedLabels:        []string{"patient", "Employee"},
+		AllowedProperties:    map[string][]string{"patient": {"name", "diagnosis"}},
+		OperationPermissions: map[string]OperationPermissions{"patient": {Update: true}},
+		RowFilters:           map[string][]string{"Patient": {"n.doctor = $user.id"}},
+		Strictness:           StrictnessStrict,
+		DeniedProperties:     map[string][]string{"*": {"ssn"}},
+	}
+
+	merged := MergePermissions(nurse, doctor)
+
+	if want := []string{"Patient", "Employee"}; !reflect.DeepEqual(merged.AllowedLabels, want) {
+		t.Errorf("AllowedLabels = %v, want %v", merged.AllowedLabels, want)
+	}
+	if want := []string{"name", "diagnosis"}; !reflect.DeepEqual(merged.AllowedProperties["Patient"], want) {
+		t.Errorf("AllowedProperties[Patient] = %v, want %v", merged.AllowedProperties["Patient"], want)
+	}
+	if want := (OperationPermissions{Read: true, Update: true}); merged.OperationPermissions["Patient"] != want {
+		t.Errorf("OperationPermissions[Patient] = %+v, want %+v", merged.OperationPermissions["Patient"], want)
+	}
+	// Employee is granted by a role without operation permissions, which leaves it unrestricted
+	if _, ok := merged.OperationPermissions["Employee"]; ok {
+		t.Errorf("OperationPermissions[Employee] is set, want it unrestricted")
+	}
+	if want := []string{"((n.ward = $user.ward)) OR ((n.doctor = $user.id))"}; !reflect.DeepEqual(merged.RowFilters["Patient"], want) {
+		t.Errorf("RowFilters[Patient] = %v, want %v", merged.RowFilters["Patient"], want)
+	}
+	if _, ok := merged.RelationshipOperations["Patient"]; ok {
+		t.Errorf("RelationshipOperations[Patient] is set, want label operations kept apart")
+	}
+	if merged.Strictness != StrictnessStrict {
+		t.Errorf("Strictness = %s, want %s", merged.Strictness, StrictnessStrict)
+	}
+	if _, denied := merged.DeniedProperty("Patient", "ssn"); !denied {
+		t.Errorf("DeniedProperty(Patient, ssn) = false, want true")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		perm    Permissions
+		wantErr bool
+	}{
+		{name: "wildcard", perm: Permissions{DeniedLabels: []string{"Secret*"}}},
+		{name: "question mark", perm: Permissions{DeniedLabels: []string{"Secret?"}}, wantErr: true},
+		{name: "character class", perm: Permissions{DeniedProperties: map[string][]string{"*": {"ss[n]"}}}, wantErr: true},
+		{
+			name: "relationship operations",
+			perm: Permissions{
+				AllowedRelationships:   []string{"TREATS"},
+				RelationshipOperations: map[string]OperationPermissions{"TREATS": {Read: true}},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.perm.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParsePermissionsRelationshipKeys(t *testing.T) {
+	// Configurations stored before relationship types had fields of their own keyed them alongside the labels
+	perm, err := parsePermissions(`{
+		"allowed_labels": ["Patient", "Owns"],
+		"allowed_relationships": ["TREATS", "OWNS"],
+		"operation_permissions": {"Patient": {"read": true}, "treats": {"read": true}, "Owns": {"read": true}},
+		"row_filters": {"TREATS": ["r.active"]},
+		"relationship_row_filters": {"TREATS": ["r.since > 2020"]}
+	}`)
+	if err != nil {
+		t.Fatalf("parsePermissions() error = %v", err)
+	}
+
+	if _, ok := perm.RelationshipOperations["treats"]; !ok {
+		t.Errorf("RelationshipOperations = %v, want treats moved from operation permissions", perm.RelationshipOperations)
+	}
+	if len(perm.OperationPermissions) != 2 {
+		t.Errorf("OperationPermissions = %v, want Patient and Owns kept", perm.OperationPermissions)
+	}
+	if len(perm.RowFilters) != 0 {
+		t.Errorf("RowFilters = %v, want TREATS moved to relationship row filters", perm.RowFilters)
+	}
+	if got := perm.RelationshipRowFilters["TREATS"]; !slices.Equal(got, []string{"r.since > 2020", "r.active"}) {
+		t.Errorf("RelationshipRowFilters[TREATS] = %v, want both filters", got)
+	}
+}
+
+func TestDeniedProperty(t *testing.T) {
+	perm := &Permissions{DeniedProperties: map[string][]string{"*": {"ssn"}, "Priv*": {"*"}}}
+	tests := []struct {
+		entity, prop string
+		denied       bool
+	}{
+		{"Patient", "ssn", true},
+		{"patient", "SSN", true},
+		{"Patient", "name", false},
+		{"PrivateNote", "text", true},
+		{"", "ssn", true},
+	}
+
+	for _, tt := range tests {
+		if _, denied := perm.DeniedProperty(tt.entity, tt.prop); denied != tt.denied {
+			t.Errorf("DeniedProperty(%q, %q) = %v, want %v", tt.entity, tt.prop, denied, tt.denied)
+		}
+	}
+}
+
+func TestMergePermissionsRelationships(t *testing.T) {
+	// A relationship type may share its name with a label, and each keeps its own operations and row filters
+	perm := &Permissions{
+		AllowedLabels:          []string{"Owns"},
+		AllowedRelationships:   []string{"OWNS"},
+		OperationPermissions:   map[string]OperationPermissions{"Owns": {Read: true}},
+		RelationshipOperations: map[string]OperationPermissions{"OWNS": {Create: true}},
+		RelationshipRowFilters: map[string][]string{"OWNS": {"n.since > 2000"}},
+	}
+
+	merged := MergePermissions(perm)
+
+	if want := (OperationPermissions{Read: true}); merged.OperationPermissions["Owns"] != want {
+		t.Errorf("OperationPermissions[Owns] = %+v, want %+v", merged.OperationPermissions["Owns"], want)
+	}
+	if want := (OperationPermissions{Create: true}); merged.RelationshipOperations["Owns"] != want {
+		t.Errorf("RelationshipOperations[Owns] = %+v, want %+v", merged.RelationshipOperations["Owns"], want)
+	}
+	if _, ok := merged.RowFilters["Owns"]; ok {
+		t.Errorf("RowFilters[Owns] is set, want the relationship filter kept apart")
+	}
+	if want := []string{"(n.since > 2000)"}; !reflect.DeepEqual(merged.RelationshipRowFilters["Owns"], want) {
+		t.Errorf("RelationshipRowFilters[Owns] = %v, want %v", merged.RelationshipRowFilters["Owns"], want)
+	}
+}
@@ -3,11 +3,15 @@ package postgres
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"os"
+	"slices"
+	"strconv"
 	"time"
 
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
@@ -31,12 +35,13 @@ func ConnectPostgres() (*pgxpool.Pool, error) {
 
 func GetUserByEmail(ctx context.Context, dbpool *pgxpool.Pool, email string) (*User, error) {
 	sql := `
-        SELECT id, org_id, name, email, hashed_bearer_token, override_permissions, created_at, updated_at FROM users WHERE email = $1
+        SELECT id, org_id, name, email, hashed_bearer_token, override_permissions, analyzer_modes, default_analyzer_mode, created_at, updated_at
+        FROM users WHERE email = $1
 	`
 	row := dbpool.QueryRow(ctx, sql, email)
 
 	var user User
-	err := row.Scan(&user.ID, &user.OrgID, &user.Name, &user.Email, &user.HashedBearerToken, &user.OverridePermissions, &user.CreatedAt, &user.UpdatedAt)
+	err := row.Scan(&user.ID, &user.OrgID, &user.Name, &user.Email, &user.HashedBearerToken, &user.OverridePermissions, &user.AnalyzerModes, &user.DefaultAnalyzerMode, &user.CreatedAt, &user.UpdatedAt)
 	if err != nil {
 		return nil, fmt.Errorf("%s", err.Error())
 	}
@@ -46,12 +51,13 @@ func GetUserByEmail(ctx context.Context, dbpool *pgxpool.Pool, email string) (*U
 
 func GetOrganizationById(ctx context.Context, dbpool *pgxpool.Pool, id int) (*Organization, error) {
 	sql := `
-        SELECT id, name, default_permissions, created_at, updated_at FROM organizations WHERE id = $1
+        SELECT id, name, default_permissions, query_timeout_ms, analyzer_modes, default_analyzer_mode, created_at, updated_at
+        FROM organizations WHERE id = $1
 	`
 	row := dbpool.QueryRow(ctx, sql, id)
 
 	var org Organization
-	err := row.Scan(&org.ID, &org.Name, &org.DefaultPermissions, &org.CreatedAt, &org.UpdatedAt)
+	err := row.Scan(&org.ID, &org.Name, &org.DefaultPermissions, &org.QueryTimeoutMs, &org.AnalyzerModes, &org.DefaultAnalyzerMode, &org.CreatedAt, &org.UpdatedAt)
 	if err != nil {
 		return nil, fmt.Errorf("%s", err.Error())
 	}
@@ -59,31 +65,260 @@ func GetOrganizationById(ctx context.Context, dbpool *pgxpool.Pool, id int) (*Or
 	return &org, nil
 }
 
+// Returns the roles granted to the user
+func GetUserRoles(ctx context.Context, dbpool *pgxpool.Pool, userId int) ([]Role, error) {
+	sql := `
+        SELECT r.id, r.org_id, r.name, r.permissions, r.created_at, r.updated_at
+        FROM roles r JOIN user_roles ur ON ur.role_id = r.id
+        WHERE ur.user_id = $1
+        ORDER BY r.id
+	`
+	rows, err := dbpool.Query(ctx, sql, userId)
+	if err != nil {
+		return nil, fmt.Errorf("%s", err.Error())
+	}
+	defer rows.Close()
+
+	var roles []Role
+	for rows.Next() {
+		var role Role
+		if err := rows.Scan(&role.ID, &role.OrgID, &role.Name, &role.Permissions, &role.CreatedAt, &role.UpdatedAt); err != nil {
+			return nil, fmt.Errorf("%s", err.Error())
+		}
+		roles = append(roles, role)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("%s", err.Error())
+	}
+
+	return roles, nil
+}
+
+// Returns the user's override, else the merged permissions of the user's roles, else the organization's defaults
 func GetUserPermissions(ctx context.Context, dbpool *pgxpool.Pool, user *User) (*Permissions, error) {
-	var effectivePermissions string
 	if user.OverridePermissions.Valid && user.OverridePermissions.String != "" {
-		effectivePermissions = user.OverridePermissions.String
-	} else {
-		org, err := GetOrganizationById(ctx, dbpool, user.OrgID)
-		if err != nil {
-			return nil, fmt.Errorf("%s", err.Error())
+		return parsePermissions(user.OverridePermissions.String)
+	}
+
+	roles, err := GetUserRoles(ctx, dbpool, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	if len(roles) > 0 {
+		rolePermissions := make([]*Permissions, len(roles))
+		for i, role := range roles {
+			if role.OrgID != user.OrgID {
+				return nil, fmt.Errorf("role '%s' belongs to another organization", role.Name)
+			}
+			perm, err := parsePermissions(role.Permissions)
+			if err != nil {
+				return nil, fmt.Errorf("invalid permissions for role '%s': %s", role.Name, err.Error())
+			}
+			rolePermissions[i] = perm
 		}
-		effectivePermissions = org.DefaultPermissions
+		return MergePermissions(rolePermissions...), nil
 	}
 
+	org, err := GetOrganizationById(ctx, dbpool, user.OrgID)
+	if err != nil {
+		return nil, fmt.Errorf("%s", err.Error())
+	}
+	return parsePermissions(org.DefaultPermissions)
+}
+
+// Returns the analyzer modes the user may select, which only narrow the organization's, and the default mode
+func GetAnalyzerPolicy(ctx context.Context, dbpool *pgxpool.Pool, user *User) (*AnalyzerPolicy, error) {
+	org, err := GetOrganizationById(ctx, dbpool, user.OrgID)
+	if err != nil {
+		return nil, err
+	}
+
+	policy := &AnalyzerPolicy{Modes: org.AnalyzerModes, Default: org.DefaultAnalyzerMode}
+	if user.AnalyzerModes != nil {
+		policy.Modes = nil
+		for _, mode := range org.AnalyzerModes {
+			if slices.Contains(user.AnalyzerModes, mode) {
+				policy.Modes = append(policy.Modes, mode)
+			}
+		}
+	}
+
+	// The user's default is used if they may select it, falling back to the organization's and then to the first permitted mode
+	if user.DefaultAnalyzerMode.Valid && policy.Allows(user.DefaultAnalyzerMode.String) {
+		policy.Default = user.DefaultAnalyzerMode.String
+	} else if !policy.Allows(policy.Default) {
+		policy.Default = ""
+		if len(policy.Modes) > 0 {
+			policy.Default = policy.Modes[0]
+		}
+	}
+
+	return policy, nil
+}
+
+// Reports whether the analyzer mode may be selected
+func (p *AnalyzerPolicy) Allows(mode string) bool {
+	return slices.Contains(p.Modes, mode)
+}
+
+func parsePermissions(raw string) (*Permissions, error) {
 	var permissions Permissions
-	if err := json.Unmarshal([]byte(effectivePermissions), &permissions); err != nil {
+	if err := json.Unmarshal([]byte(raw), &permissions); err != nil {
 		return nil, fmt.Errorf("%s", err.Error())
 	}
+	permissions.migrateRelationshipKeys()
+	if err := permissions.Validate(); err != nil {
+		return nil, err
+	}
 
 	return &permissions, nil
 }
 
-func LogQuery(ctx context.Context, dbpool *pgxpool.Pool, userId int, query, decision, rewrittenQuery string) error {
+// Returns the user's attributes keyed by attribute name, with each value converted to its Go type
+func GetUserAttributes(ctx context.Context, dbpool *pgxpool.Pool, userId int) (map[string]any, error) {
+	sql := `
+        SELECT id, user_id, key, value, value_type, created_at, updated_at FROM user_attributes WHERE user_id = $1
+	`
+	rows, err := dbpool.Query(ctx, sql, userId)
+	if err != nil {
+		return nil, fmt.Errorf("%s", err.Error())
+	}
+	defer rows.Close()
+
+	attributes := make(map[string]any)
+	for rows.Next() {
+		var attr UserAttribute
+		if err := rows.Scan(&attr.ID, &attr.UserID, &attr.Key, &attr.Value, &attr.ValueType, &attr.CreatedAt, &attr.UpdatedAt); err != nil {
+			return nil, fmt.Errorf("%s", err.Error())
+		}
+
+		value, err := parseAttributeValue(attr)
+		if err != nil {
+			return nil, err
+		}
+		attributes[attr.Key] = value
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("%s", err.Error())
+	}
+
+	return attributes, nil
+}
+
+// Creates or replaces a user attribute, storing its type alongside the value
+func SetUserAttribute(ctx context.Context, dbpool *pgxpool.Pool, userId int, key string, value any) error {
+	var valueType string
+	switch value.(type) {
+	case string:
+		valueType = "string"
+	case int, int32, int64:
+		valueType = "integer"
+	case float32, float64:
+		valueType = "float"
+	case bool:
+		valueType = "boolean"
+	default:
+		return fmt.Errorf("unsupported type %T for attribute '%s'", value, key)
+	}
+
+	sql := `
+        INSERT INTO user_attributes (user_id, key, value, value_type) VALUES ($1, $2, $3, $4)
+        ON CONFLICT (user_id, key) DO UPDATE SET value = EXCLUDED.value, value_type = EXCLUDED.value_type
+	`
+	_, err := dbpool.Exec(ctx, sql, userId, key, fmt.Sprint(value), valueType)
+
+	return err
+}
+
+func parseAttributeValue(attr UserAttribute) (any, error) {
+	var value any
+	var err error
+	switch attr.ValueType {
+	case "string":
+		value = attr.Value
+	case "integer":
+		value, err = strconv.ParseInt(attr.Value, 10, 64)
+	case "float":
+		value, err = strconv.ParseFloat(attr.Value, 64)
+	case "boolean":
+		value, err = strconv.ParseBool(attr.Value)
+	default:
+		err = fmt.Errorf("unknown type '%s'", attr.ValueType)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid value for attribute '%s': %s", attr.Key, err.Error())
+	}
+	return value, nil
+}
+
+// Logs a query and its decision, along with the violations that caused it, which are stored as JSON
+// The entry is appended to its organization's hash chain, see hashLog
+func LogQuery(ctx context.Context, dbpool *pgxpool.Pool, orgId, userId int, query, decision, rewrittenQuery string, violations any) error {
+	violationsJSON, err := json.Marshal(violations)
+	if err != nil {
+		return fmt.Errorf("%s", err.Error())
+	}
+
+	entry := Log{
+		OrgID:          orgId,
+		UserID:         userId,
+		Query:          query,
+		Decision:       decision,
+		RewrittenQuery: rewrittenQuery,
+		Violations:     string(violationsJSON),
+		CreatedAt:      time.Now().Truncate(time.Microsecond), // Postgres stores timestamps with microsecond precision
+	}
+
+	tx, err := dbpool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("%s", err.Error())
+	}
+	defer tx.Rollback(ctx)
+
+	// Entries of the same organization are appended one at a time, so each links to the one before it
+	if _, err := tx.Exec(ctx, "SELECT pg_advisory_xact_lock($1, $2)", logChainLock, orgId); err != nil {
+		return fmt.Errorf("%s", err.Error())
+	}
+	err = tx.QueryRow(ctx, "SELECT hash FROM logs WHERE org_id = $1 ORDER BY id DESC LIMIT 1", orgId).Scan(&entry.PrevHash)
+	if errors.Is(err, pgx.ErrNoRows) {
+		entry.PrevHash = GenesisHash
+	} else if err != nil {
+		return fmt.Errorf("%s", err.Error())
+	}
+	entry.Hash, err = hashLog(&entry)
+	if err != nil {
+		return err
+	}
+
+	sql := `
+        INSERT INTO logs (org_id, user_id, query, decision, rewritten_query, violations, created_at, prev_hash, hash)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+	`
+	_, err = tx.Exec(ctx, sql, entry.OrgID, entry.UserID, entry.Query, entry.Decision, entry.RewrittenQuery, entry.Violations, entry.CreatedAt, entry.PrevHash, entry.Hash)
+	if err != nil {
+		return fmt.Errorf("%s", err.Error())
+	}
+
+	return tx.Commit(ctx)
+}
+
+// Logs a query the regex and parser analyzers disagreed on, along with the rewritten query and violations of each
+// A rewritten query is stored as null unless the analyzer decided Rewritten
+func LogDisagreement(ctx context.Context, dbpool *pgxpool.Pool, orgId, userId int, query, regexDecision, parserDecision, regexQuery, parserQuery string, regexViolations, parserViolations any) error {
+	regexJSON, err := json.Marshal(regexViolations)
+	if err != nil {
+		return fmt.Errorf("%s", err.Error())
+	}
+	parserJSON, err := json.Marshal(parserViolations)
+	if err != nil {
+		return fmt.Errorf("%s", err.Error())
+	}
+
 	sql := `
-        INSERT INTO logs (user_id, query, decision, rewritten_query, created_at) VALUES ($1, $2, $3, $4, $5)
+        INSERT INTO analyzer_disagreements (org_id, user_id, query, regex_decision, parser_decision, regex_rewritten_query, parser_rewritten_query, regex_violations, parser_violations, created_at)
+        VALUES ($1, $2, $3, $4, $5, NULLIF($6, ''), NULLIF($7, ''), $8, $9, $10)
 	`
-	_, err := dbpool.Exec(ctx, sql, userId, query, decision, rewrittenQuery, time.Now())
+	_, err = dbpool.Exec(ctx, sql, orgId, userId, query, regexDecision, parserDecision, regexQuery, parserQuery, string(regexJSON), string(parserJSON), time.Now())
 
 	return err
 }
@@ -0,0 +1,212 @@
+package rewriter
+
+import (
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/antlr4-go/antlr/v4"
+	"github.com/danielbahrami/se10-mt/internal/parser"
+)
+
+// A read of properties that bypasses property lookups, e.g. properties(n), keys(n), n[$key] or n['name']
+// Key is set when the property is a string literal, and Computed when the properties read cannot be determined
+type DynamicAccess struct {
+	Expr     antlr.ParserRuleContext // The expression that performs the access, which is replaced to remove it
+	Variable string                  // The variable whose properties are read, if the access is performed on one
+	Key      string
+	Computed bool
+	Form     string // How the properties are read, for violation messages, e.g. "properties(n)" or "n[$key]"
+}
+
+// Returns the dynamic property accesses in the subtree, in the order they appear in the query
+// Indexing with an integer, e.g. list[0], or slicing a list, e.g. list[1..3], is not a property access
+func FindDynamicAccesses(tree antlr.Tree) []DynamicAccess {
+	var accesses []DynamicAccess
+
+	for _, fn := range findAll[*parser.OC_FunctionInvocationContext](tree) {
+		// Names are compared canonically, so `properties`(n) is caught as well
+		fnName := fn.OC_FunctionName()
+		name := strings.ToLower(QualifiedName(fnName.OC_Namespace(), fnName.OC_SymbolicName()))
+		if name != "properties" && name != "keys" {
+			continue
+		}
+		access := DynamicAccess{Expr: fn, Computed: true, Form: originalText(fn)}
+		if args := fn.AllOC_Expression(); len(args) == 1 {
+			access.Variable = soleVariable(args[0])
+		}
+		accesses = append(accesses, access)
+	}
+
+	for _, index := range findAll[*parser.OC_ListOperatorExpressionContext](tree) {
+		if len(index.AllOC_Expression()) != 1 || hasRange(index) {
+			continue
+		}
+		expr, ok := index.GetParent().(*parser.OC_NonArithmeticOperatorExpressionContext)
+		if !ok {
+			continue
+		}
+
+		access := DynamicAccess{Expr: expr, Form: originalText(expr)}
+		if atom := expr.OC_Atom(); atom != nil {
+			// Indexing a literal list or map, e.g. [1, 2, 3][i], reads no properties unless the literal holds variables,
+			// as in [p][0]['ssn'], whose entities cannot be told apart
+			if literal := atom.OC_Literal(); literal != nil {
+				if len(findAll[*parser.OC_VariableContext](literal)) == 0 {
+					continue
+				}
+				access.Computed = true
+			}
+			if v := atom.OC_Variable(); v != nil && indexesAtom(expr, index) {
+				access.Variable = v.GetText()
+			}
+		}
+
+		key := index.OC_Expression(0)
+		if literal, ok := soleLiteral(key); ok {
+			if literal.OC_NumberLiteral() != nil {
+				continue
+			}
+			if s := literal.StringLiteral(); s != nil {
+				access.Key = unquoteString(s.GetText())
+				accesses = append(accesses, access)
+				continue
+			}
+		}
+		access.Computed = true
+		accesses = append(accesses, access)
+	}
+
+	return accesses
+}
+
+// Replaces every dynamic property access that remove reports true for with null, keeping column names
+// Returns the number of accesses replaced
+func (r *Rewriter) RemoveDynamicAccesses(remove func(DynamicAccess) bool) int {
+	replaced := 0
+	for _, access := range FindDynamicAccesses(r.tree) {
+		if !remove(access) {
+			continue
+		}
+		log.Printf("Replacing '%s' with null due to a dynamic property access\n", access.Form)
+
+		text := "null"
+		if item := projectionItemOf(access.Expr); item != nil && item.OC_Variable() == nil {
+			text = "null AS " + QuoteName(r.original(item))
+		}
+		r.replace(access.Expr, text)
+		replaced++
+	}
+	return replaced
+}
+
+// Returns the projection item the expression makes up on its own, if any
+func projectionItemOf(expr antlr.ParserRuleContext) *parser.OC_ProjectionItemContext {
+	for parent := expr.GetParent(); parent != nil; parent = parent.GetParent() {
+		ctx, ok := parent.(antlr.ParserRuleContext)
+		if !ok || ctx.GetStart() != expr.GetStart() || ctx.GetStop() != expr.GetStop() {
+			return nil
+		}
+		if item, ok := parent.(*parser.OC_ProjectionItemContext); ok {
+			return item
+		}
+	}
+	return nil
+}
+
+// Returns the variable the expression consists of, if it is nothing more than a variable
+func soleVariable(expr antlr.ParserRuleContext) string {
+	for _, atom := range findAll[*parser.OC_AtomContext](expr) {
+		if atom.GetStart() == expr.GetStart() && atom.GetStop() == expr.GetStop() && atom.OC_Variable() != nil {
+			return atom.OC_Variable().GetText()
+		}
+		break
+	}
+	return ""
+}
+
+// Returns the literal the expression consists of, if it is nothing more than a literal
+func soleLiteral(expr antlr.ParserRuleContext) (*parser.OC_LiteralContext, bool) {
+	for _, literal := range findAll[*parser.OC_LiteralContext](expr) {
+		if literal.GetStart() == expr.GetStart() && literal.GetStop() == expr.GetStop() {
+			return literal, true
+		}
+		break
+	}
+	return nil, false
+}
+
+// Reports whether the list operator is a slice, e.g. [1..3]
+func hasRange(index *parser.OC_ListOperatorExpressionContext) bool {
+	for _, child := range index.GetChildren() {
+		if t, ok := child.(antlr.TerminalNode); ok && t.GetText() == ".." {
+			return true
+		}
+	}
+	return false
+}
+
+// Reports whether the list operator directly follows the atom, ignoring whitespace, so it indexes the atom itself
+func indexesAtom(expr *parser.OC_NonArithmeticOperatorExpressionContext, index *parser.OC_ListOperatorExpressionContext) bool {
+	for _, child := range expr.GetChildren()[1:] {
+		if _, ok := child.(antlr.TerminalNode); ok {
+			continue
+		}
+		return child == index
+	}
+	return false
+}
+
+// Returns the text of a parse-tree node as written in the query
+func originalText(ctx antlr.ParserRuleContext) string {
+	stream := ctx.GetStart().GetInputStream()
+	return stream.GetTextFromInterval(antlr.NewInterval(ctx.GetStart().GetStart(), ctx.GetStop().GetStop()))
+}
+
+// Returns the value of a single- or double-quoted Cypher string literal
+func unquoteString(literal string) string {
+	if len(literal) < 2 {
+		return literal
+	}
+	body := literal[1 : len(literal)-1]
+	if !strings.Contains(body, `\`) {
+		return body
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(body); i++ {
+		if body[i] != '\\' || i+1 == len(body) {
+			b.WriteByte(body[i])
+			continue
+		}
+		i++
+		switch body[i] {
+		case 'n':
+			b.WriteByte('\n')
+		case 't':
+			b.WriteByte('\t')
+		case 'r':
+			b.WriteByte('\r')
+		case 'b':
+			b.WriteByte('\b')
+		case 'f':
+			b.WriteByte('\f')
+		case 'u', 'U':
+			size := 4
+			if body[i] == 'U' {
+				size = 8
+			}
+			if i+size < len(body) {
+				if code, err := strconv.ParseUint(body[i+1:i+1+size], 16, 32); err == nil {
+					b.WriteRune(rune(code))
+					i += size
+					continue
+				}
+			}
+			b.WriteByte(body[i])
+		default:
+			b.WriteByte(body[i])
+		}
+	}
+	return b.String()
+}
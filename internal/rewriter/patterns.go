@@ -0,0 +1,477 @@
+package rewriter
+
+import (
+	"fmt"
+	"maps"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/antlr4-go/antlr/v4"
+	"github.com/danielbahrami/se10-mt/internal/analyzer"
+	"github.com/danielbahrami/se10-mt/internal/parser"
+)
+
+// The variable row filter templates use to refer to the filtered node or relationship
+const FilterVariable = "n"
+
+// Constrains every unlabelled node in a pattern to the labels and none of the denied labels, and every untyped relationship
+// to the relationship types
+// Returns a description of each constraint that was added
+func (r *Rewriter) ConstrainPatterns(labels, relTypes, deniedLabels []string) []analyzer.Violation {
+	var constraints []analyzer.Violation
+	for _, node := range findAll[*parser.OC_NodePatternContext](r.tree) {
+		scope := patternScope(node)
+		if scope == nil {
+			continue
+		}
+
+		if node.OC_NodeLabels() == nil {
+			variable := r.nodeVariable(node)
+			r.addPredicate(scope, labelPredicate(variable, labels))
+			if denied := r.deniedLabelsPredicate(variable, deniedLabels); denied != "" {
+				r.addPredicate(scope, denied)
+			}
+			constraints = append(constraints, analyzer.Violation{
+				Kind:     analyzer.ViolationConstraint,
+				Variable: variable,
+				Span:     analyzer.SpanOf(node),
+				RuleID:   "allowed_labels",
+				Message:  fmt.Sprintf("unlabelled node '%s' constrained to the allowed labels", variable),
+			})
+		}
+	}
+
+	for _, rel := range findAll[*parser.OC_RelationshipPatternContext](r.tree) {
+		scope := patternScope(rel)
+		detail := rel.OC_RelationshipDetail()
+		if scope == nil || (detail != nil && detail.OC_RelationshipTypes() != nil) {
+			continue
+		}
+
+		variable := r.relVariable(rel)
+		r.addPredicate(scope, r.forEachRelationship(rel, variable, func(v string) string {
+			return typePredicate(v, relTypes)
+		}))
+		constraints = append(constraints, analyzer.Violation{
+			Kind:     analyzer.ViolationConstraint,
+			Variable: variable,
+			Span:     analyzer.SpanOf(rel),
+			RuleID:   "allowed_relationships",
+			Message:  fmt.Sprintf("untyped relationship '%s' constrained to the allowed relationship types", variable),
+		})
+	}
+
+	return constraints
+}
+
+// Returns the MATCH, pattern comprehension, pattern predicate or existential subquery whose WHERE clause can constrain
+// the node or relationship pattern, or nil for patterns in CREATE and MERGE
+func patternScope(tree antlr.Tree) antlr.ParserRuleContext {
+	for parent := tree.GetParent(); parent != nil; parent = parent.GetParent() {
+		switch scope := parent.(type) {
+		case *parser.OC_MatchContext, *parser.OC_PatternComprehensionContext, *parser.OC_PatternPredicateContext:
+			return scope.(antlr.ParserRuleContext)
+		case *parser.OC_ExistentialSubqueryContext:
+			if scope.OC_Pattern() != nil {
+				return scope
+			}
+		case *parser.OC_CreateContext, *parser.OC_MergeContext:
+			return nil
+		}
+	}
+	return nil
+}
+
+// Adds the row filters of each label and relationship type to the WHERE clause of every MATCH that can bind it
+// Returns a description of each filter that was added
+func (r *Rewriter) ApplyRowFilters(labelFilters, relFilters map[string][]string) ([]analyzer.Violation, error) {
+	if len(labelFilters) == 0 && len(relFilters) == 0 {
+		return nil, nil
+	}
+
+	if err := r.checkUnfilterablePatterns(labelFilters, relFilters); err != nil {
+		return nil, err
+	}
+
+	var applied []analyzer.Violation
+	for _, match := range findAll[*parser.OC_MatchContext](r.tree) {
+		pattern := match.OC_Pattern()
+		if pattern == nil {
+			continue
+		}
+
+		for _, node := range findAll[*parser.OC_NodePatternContext](pattern) {
+			labels := PatternLabels(node)
+			for _, label := range slices.Sorted(maps.Keys(labelFilters)) {
+				templates := labelFilters[label]
+				if len(labels) > 0 && !labels[strings.ToLower(label)] {
+					continue
+				}
+
+				variable := r.nodeVariable(node)
+				for _, template := range templates {
+					filter, err := instantiate(template, variable)
+					if err != nil {
+						return nil, err
+					}
+					// Unlabelled nodes are only filtered when they turn out to have the label
+					if len(labels) == 0 {
+						filter = fmt.Sprintf("(NOT %s OR %s)", r.hasLabelPredicate(variable, label), filter)
+					}
+					r.addPredicate(match, filter)
+				}
+				applied = append(applied, analyzer.Violation{
+					Kind:     analyzer.ViolationRowFilter,
+					Entity:   label,
+					Variable: variable,
+					Span:     analyzer.SpanOf(node),
+					RuleID:   fmt.Sprintf("row_filters[%s]", label),
+					Message:  fmt.Sprintf("row filter on label '%s' applied to '%s'", label, variable),
+				})
+			}
+		}
+
+		for _, rel := range findAll[*parser.OC_RelationshipPatternContext](pattern) {
+			predicates, err := r.relationshipFilters(rel, labelFilters, relFilters)
+			if err != nil {
+				return nil, err
+			}
+			for _, predicate := range predicates {
+				r.addPredicate(match, predicate)
+			}
+			if len(predicates) > 0 {
+				applied = append(applied, analyzer.Violation{
+					Kind:     analyzer.ViolationRowFilter,
+					Variable: r.relVariable(rel),
+					Span:     analyzer.SpanOf(rel),
+					RuleID:   "row_filters",
+					Message:  fmt.Sprintf("row filters applied to relationship '%s'", r.relVariable(rel)),
+				})
+			}
+		}
+	}
+
+	return applied, nil
+}
+
+// Returns the row filter predicates for a relationship pattern
+// For variable-length relationships the nodes traversed along the way are filtered as well
+func (r *Rewriter) relationshipFilters(rel *parser.OC_RelationshipPatternContext, labelFilters, relFilters map[string][]string) ([]string, error) {
+	types := patternTypes(rel)
+	detail := rel.OC_RelationshipDetail()
+	isVarLength := detail != nil && detail.OC_RangeLiteral() != nil
+
+	var predicates []string
+	for _, relType := range slices.Sorted(maps.Keys(relFilters)) {
+		templates := relFilters[relType]
+		if len(types) > 0 && !types[strings.ToLower(relType)] {
+			continue
+		}
+
+		variable := r.relVariable(rel)
+		for _, template := range templates {
+			var err error
+			predicates = append(predicates, r.forEachRelationship(rel, variable, func(v string) string {
+				filter, e := instantiate(template, v)
+				if e != nil {
+					err = e
+				}
+				// Relationships that may have other types are only filtered when they have this type
+				if len(types) != 1 {
+					filter = fmt.Sprintf("(toLower(type(%s)) <> %s OR %s)", v, QuoteString(strings.ToLower(relType)), filter)
+				}
+				return filter
+			}))
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if !isVarLength {
+		return predicates, nil
+	}
+
+	variable := r.relVariable(rel)
+	for _, label := range slices.Sorted(maps.Keys(labelFilters)) {
+		for _, template := range labelFilters[label] {
+			var err error
+			predicates = append(predicates, r.forEachRelationship(rel, variable, func(v string) string {
+				var conditions []string
+				for _, endpoint := range []string{"startNode(" + v + ")", "endNode(" + v + ")"} {
+					filter, e := instantiate(template, endpoint)
+					if e != nil {
+						err = e
+					}
+					conditions = append(conditions, fmt.Sprintf("(NOT %s OR %s)", r.hasLabelPredicate(endpoint, label), filter))
+				}
+				return strings.Join(conditions, " AND ")
+			}))
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return predicates, nil
+}
+
+// Fails if a filtered label or relationship type could be bound by a pattern that has no WHERE clause,
+// such as in MERGE, pattern predicates, pattern comprehensions and existential subqueries without MATCH
+func (r *Rewriter) checkUnfilterablePatterns(labelFilters, relFilters map[string][]string) error {
+	for _, node := range findAll[*parser.OC_NodePatternContext](r.tree) {
+		if inClausePattern(node) {
+			continue
+		}
+		labels := PatternLabels(node)
+		for label := range labelFilters {
+			if len(labels) == 0 || labels[strings.ToLower(label)] {
+				return fmt.Errorf("row filter on label '%s' cannot be enforced on pattern '%s'", label, r.original(node))
+			}
+		}
+	}
+
+	for _, rel := range findAll[*parser.OC_RelationshipPatternContext](r.tree) {
+		if inClausePattern(rel) {
+			continue
+		}
+		types := patternTypes(rel)
+		for relType := range relFilters {
+			if len(types) == 0 || types[strings.ToLower(relType)] {
+				return fmt.Errorf("row filter on relationship type '%s' cannot be enforced on pattern '%s'", relType, r.original(rel))
+			}
+		}
+	}
+
+	return nil
+}
+
+// Reports whether a node or relationship pattern belongs to the pattern of a MATCH or CREATE clause,
+// rather than to a MERGE, a pattern predicate or comprehension, or an existential subquery without MATCH
+func inClausePattern(tree antlr.Tree) bool {
+	for parent := tree.GetParent(); parent != nil; parent = parent.GetParent() {
+		switch parent.(type) {
+		case *parser.OC_MatchContext, *parser.OC_CreateContext:
+			return true
+		case *parser.OC_MergeContext, *parser.OC_RelationshipsPatternContext, *parser.OC_ExistentialSubqueryContext:
+			return false
+		}
+	}
+	return false
+}
+
+// Instantiates a row filter template by replacing the filter variable with the given expression
+func instantiate(template, expr string) (string, error) {
+	const prefix = "RETURN "
+	rw, err := New(prefix + template)
+	if err != nil {
+		return "", fmt.Errorf("invalid row filter '%s': %w", template, err)
+	}
+
+	for _, atom := range findAll[*parser.OC_AtomContext](rw.tree) {
+		if v := atom.OC_Variable(); v != nil && v.GetText() == FilterVariable {
+			rw.replace(atom, expr)
+		}
+	}
+
+	return "(" + strings.TrimPrefix(rw.Text(), prefix) + ")", nil
+}
+
+// Returns the predicate for a relationship pattern, applied to every relationship of a variable-length relationship
+func (r *Rewriter) forEachRelationship(rel *parser.OC_RelationshipPatternContext, variable string, predicate func(string) string) string {
+	detail := rel.OC_RelationshipDetail()
+	if detail == nil || detail.OC_RangeLiteral() == nil {
+		return predicate(variable)
+	}
+
+	item := r.freshVariable("_r")
+	return fmt.Sprintf("all(%s IN %s WHERE %s)", item, variable, predicate(item))
+}
+
+// Returns the variable of a node pattern, giving anonymous nodes a generated variable
+func (r *Rewriter) nodeVariable(node *parser.OC_NodePatternContext) string {
+	if v := node.OC_Variable(); v != nil {
+		return v.GetText()
+	}
+	if variable, ok := r.variables[node]; ok {
+		return variable
+	}
+
+	variable := r.freshVariable("_n")
+	r.rewriter.InsertAfterDefault(node.GetStart().GetTokenIndex(), variable)
+	r.variables[node] = variable
+	return variable
+}
+
+// Returns the variable of a relationship pattern, giving anonymous relationships a generated variable
+func (r *Rewriter) relVariable(rel *parser.OC_RelationshipPatternContext) string {
+	detail := rel.OC_RelationshipDetail()
+	if detail != nil && detail.OC_Variable() != nil {
+		return detail.OC_Variable().GetText()
+	}
+	if variable, ok := r.variables[rel]; ok {
+		return variable
+	}
+
+	variable := r.freshVariable("_r")
+	if detail != nil {
+		r.rewriter.InsertAfterDefault(detail.GetStart().GetTokenIndex(), variable)
+	} else {
+		// A relationship without details such as --> gets them after its first dash
+		for _, child := range rel.GetChildren() {
+			if dash, ok := child.(*parser.OC_DashContext); ok {
+				r.rewriter.InsertAfterDefault(dash.GetStop().GetTokenIndex(), "["+variable+"]")
+				break
+			}
+		}
+	}
+	r.variables[rel] = variable
+	return variable
+}
+
+// Returns a variable name with the prefix that is not yet used in the query, and marks it as used
+func (r *Rewriter) freshVariable(prefix string) string {
+	for i := 0; ; i++ {
+		name := fmt.Sprintf("%s%d", prefix, i)
+		if !r.used[name] {
+			r.used[name] = true
+			return name
+		}
+	}
+}
+
+// Queues a predicate for the WHERE clause of a MATCH, pattern comprehension, pattern predicate or existential subquery
+// Predicates are only added to the query text when it is requested, so each WHERE clause is edited once
+func (r *Rewriter) addPredicate(scope antlr.ParserRuleContext, predicate string) {
+	if _, ok := r.predicates[scope]; !ok {
+		r.scopes = append(r.scopes, scope)
+	}
+	r.predicates[scope] = append(r.predicates[scope], predicate)
+}
+
+// Adds the queued predicates to the WHERE clause of each scope, innermost first, creating the WHERE clause if there is none
+func (r *Rewriter) flushPredicates() {
+	slices.SortStableFunc(r.scopes, func(a, b antlr.ParserRuleContext) int {
+		return depth(b) - depth(a)
+	})
+
+	for _, scope := range r.scopes {
+		joined := strings.Join(r.predicates[scope], " AND ")
+		var where parser.IOC_WhereContext
+		var pattern antlr.ParserRuleContext
+		switch s := scope.(type) {
+		case *parser.OC_MatchContext:
+			where, pattern = s.OC_Where(), s.OC_Pattern()
+		case *parser.OC_PatternComprehensionContext:
+			where, pattern = s.OC_Where(), s.OC_RelationshipsPattern()
+		case *parser.OC_ExistentialSubqueryContext:
+			where, pattern = s.OC_Where(), s.OC_Pattern()
+		case *parser.OC_PatternPredicateContext:
+			r.rewriter.InsertBeforeDefault(s.GetStart().GetTokenIndex(), "EXISTS { ")
+			r.rewriter.InsertAfterDefault(s.GetStop().GetTokenIndex(), " WHERE "+joined+" }")
+			continue
+		}
+
+		if where != nil && where.OC_Expression() != nil {
+			expr := where.OC_Expression()
+			r.rewriter.InsertBeforeDefault(expr.GetStart().GetTokenIndex(), "(")
+			r.rewriter.InsertAfterDefault(expr.GetStop().GetTokenIndex(), ") AND "+joined)
+			continue
+		}
+		r.rewriter.InsertAfterDefault(pattern.GetStop().GetTokenIndex(), " WHERE "+joined)
+	}
+
+	r.scopes = nil
+	r.predicates = make(map[antlr.ParserRuleContext][]string)
+}
+
+// Returns the number of ancestors of the parse-tree node
+func depth(tree antlr.Tree) int {
+	n := 0
+	for parent := tree.GetParent(); parent != nil; parent = parent.GetParent() {
+		n++
+	}
+	return n
+}
+
+// Returns the lowercased labels of a node pattern
+func PatternLabels(node *parser.OC_NodePatternContext) map[string]bool {
+	labels := make(map[string]bool)
+	if labelsCtx := node.OC_NodeLabels(); labelsCtx != nil {
+		for _, nodeLabelCtx := range labelsCtx.AllOC_NodeLabel() {
+			if labelNameCtx := nodeLabelCtx.OC_LabelName(); labelNameCtx != nil {
+				labels[strings.ToLower(analyzer.CanonicalName(labelNameCtx.GetText()))] = true
+			}
+		}
+	}
+	return labels
+}
+
+// Returns the lowercased types of a relationship pattern
+func patternTypes(rel *parser.OC_RelationshipPatternContext) map[string]bool {
+	types := make(map[string]bool)
+	if detail := rel.OC_RelationshipDetail(); detail != nil && detail.OC_RelationshipTypes() != nil {
+		for _, relTypeCtx := range detail.OC_RelationshipTypes().AllOC_RelTypeName() {
+			types[strings.ToLower(analyzer.CanonicalName(relTypeCtx.GetText()))] = true
+		}
+	}
+	return types
+}
+
+// Returns a predicate that holds when the node has one of the labels
+func labelPredicate(variable string, labels []string) string {
+	if len(labels) == 0 {
+		return "false"
+	}
+
+	alternatives := make([]string, len(labels))
+	for i, label := range labels {
+		alternatives[i] = variable + ":" + QuoteName(label)
+	}
+	return "(" + strings.Join(alternatives, " OR ") + ")"
+}
+
+// Returns a predicate that holds when the node has the label, compared case-insensitively like the labels of patterns
+func (r *Rewriter) hasLabelPredicate(node, label string) string {
+	l := r.freshVariable("_l")
+	return fmt.Sprintf("any(%s IN labels(%s) WHERE toLower(%s) = %s)", l, node, l, QuoteString(strings.ToLower(label)))
+}
+
+// Returns a predicate that holds when the node has none of the denied labels, or "" if no label is denied
+// Labels are compared case-insensitively, and denied names with * wildcards match any characters
+func (r *Rewriter) deniedLabelsPredicate(variable string, deniedLabels []string) string {
+	if len(deniedLabels) == 0 {
+		return ""
+	}
+
+	label := r.freshVariable("_l")
+	conditions := make([]string, len(deniedLabels))
+	for i, denied := range deniedLabels {
+		denied = strings.ToLower(denied)
+		if !strings.Contains(denied, "*") {
+			conditions[i] = fmt.Sprintf("toLower(%s) = %s", label, QuoteString(denied))
+			continue
+		}
+
+		parts := strings.Split(denied, "*")
+		for j, part := range parts {
+			parts[j] = regexp.QuoteMeta(part)
+		}
+		conditions[i] = fmt.Sprintf("toLower(%s) =~ %s", label, QuoteString(strings.Join(parts, ".*")))
+	}
+	return fmt.Sprintf("NOT any(%s IN labels(%s) WHERE %s)", label, variable, strings.Join(conditions, " OR "))
+}
+
+// Returns a predicate that holds when the relationship has one of the types
+func typePredicate(variable string, relTypes []string) string {
+	if len(relTypes) == 0 {
+		return "false"
+	}
+
+	quoted := make([]string, len(relTypes))
+	for i, relType := range relTypes {
+		quoted[i] = QuoteString(relType)
+	}
+	return fmt.Sprintf("type(%s) IN [%s]", variable, strings.Join(quoted, ", "))
+}
@@ -0,0 +1,90 @@
+package rewriter
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/danielbahrami/se10-mt/internal/analyzer"
+	"github.com/danielbahrami/se10-mt/internal/postgres"
+)
+
+// Rewrites the query so it no longer returns the disallowed properties and dynamic property accesses of the violations
+// Returns false if nothing in the query had to be rewritten, in which case the violations did not apply to it
+// Fails if any violation cannot be rewritten, or if the strictness does not allow the rewrite that is needed
+func RewriteQuery(cypher string, violations []analyzer.Violation, strictness string) (string, bool, error) {
+	log.Println("Attempting to rewrite the query. Violations:", violations)
+
+	// Determine if there are any violations other than disallowed properties
+	var disallowedProps []Property
+	dynamicAccesses := make(map[int]bool) // Start offsets of the disallowed dynamic property accesses
+	for _, v := range violations {
+		if v.Kind == analyzer.ViolationDynamic && v.Span != nil {
+			dynamicAccesses[v.Span.Start] = true
+			continue
+		}
+		if v.Kind != analyzer.ViolationProperty {
+			log.Println("Rewriting not possible due to violations other than disallowed properties")
+			return "", false, fmt.Errorf("Cannot safely rewrite the query")
+		}
+		disallowedProps = append(disallowedProps, Property{Variable: v.Variable, Name: v.Property})
+	}
+
+	// Dynamic property accesses can only be neutralized, which the strictness must allow
+	if len(dynamicAccesses) > 0 && strictness != postgres.StrictnessRewrite {
+		log.Println("Rewriting not possible due to disallowed dynamic property accesses")
+		return "", false, fmt.Errorf("Cannot safely rewrite the query")
+	}
+
+	// Dynamic property accesses are replaced first, so the property rewrites below work on the result
+	if len(dynamicAccesses) > 0 {
+		rw, err := New(cypher)
+		if err != nil {
+			log.Println("Rewriting failed:", err)
+			return "", false, fmt.Errorf("Cannot safely rewrite the query")
+		}
+		rw.RemoveDynamicAccesses(func(access DynamicAccess) bool {
+			return dynamicAccesses[analyzer.SpanOf(access.Expr).Start]
+		})
+		cypher = rw.Text()
+	}
+
+	rw, err := New(cypher)
+	if err != nil {
+		log.Println("Rewriting failed:", err)
+		return "", false, fmt.Errorf("Cannot safely rewrite the query")
+	}
+	removed := 0
+	if len(disallowedProps) > 0 {
+		if removed, err = rw.RemoveProperties(disallowedProps); err != nil {
+			log.Println("Rewriting failed:", err)
+			return "", false, fmt.Errorf("Cannot safely rewrite the query")
+		}
+	}
+
+	// Without any edit or leak the disallowed properties were never looked up on an entity
+	leaks := rw.Leaks(disallowedProps)
+	if removed == 0 && len(leaks) == 0 && len(dynamicAccesses) == 0 {
+		if strictness != postgres.StrictnessRewrite {
+			log.Println("Rewriting not possible: no disallowed property was found to remove")
+			return "", false, fmt.Errorf("Cannot safely rewrite the query")
+		}
+		log.Println("Rewriting not needed: no disallowed property was found to remove")
+		return cypher, false, nil
+	}
+
+	// Disallowed properties used outside of the RETURN projection are either blocked or neutralized
+	if len(leaks) > 0 {
+		if strictness != postgres.StrictnessRewrite {
+			log.Printf("Rewriting not possible due to disallowed properties used outside of RETURN: %v\n", leaks)
+			return "", false, fmt.Errorf("Cannot safely rewrite the query")
+		}
+		if err := rw.NeutralizeProperties(disallowedProps); err != nil {
+			log.Println("Rewriting failed:", err)
+			return "", false, fmt.Errorf("Cannot safely rewrite the query")
+		}
+	}
+
+	rewrittenQuery := rw.Text()
+	log.Println("Rewriting succeeded. New query:", rewrittenQuery)
+	return rewrittenQuery, true, nil // 'true' indicates a rewritten query was returned
+}
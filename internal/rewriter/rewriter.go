@@ -0,0 +1,360 @@
+package rewriter
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/antlr4-go/antlr/v4"
+	"github.com/danielbahrami/se10-mt/internal/analyzer"
+	"github.com/danielbahrami/se10-mt/internal/parser"
+)
+
+// Identifies a property that must be removed from a query
+// An empty Variable matches the property regardless of the variable it is accessed on
+type Property struct {
+	Variable string
+	Name     string
+}
+
+// Rewrites a Cypher query by editing the token stream behind its ANTLR parse-tree
+// The original text, including whitespace and comments, is kept everywhere outside of the edited nodes
+type Rewriter struct {
+	tokens     *antlr.CommonTokenStream
+	tree       parser.IOC_CypherContext
+	rewriter   *antlr.TokenStreamRewriter
+	used       map[string]bool                      // Variable names in the query, including generated ones
+	variables  map[antlr.ParserRuleContext]string   // Variables generated for anonymous nodes and relationships
+	predicates map[antlr.ParserRuleContext][]string // Predicates to add to the WHERE clause of each MATCH or other scope
+	scopes     []antlr.ParserRuleContext            // Scopes with predicates, in the order they were added
+}
+
+// Parses the Cypher query and creates a new Rewriter instance for it
+// Fails with an analyzer.SyntaxError if the query cannot be fully parsed
+func New(cypher string) (*Rewriter, error) {
+	errListener := analyzer.NewSyntaxErrorListener()
+	is := antlr.NewInputStream(cypher)
+	lex := parser.NewCypherLexer(is)
+	lex.RemoveErrorListeners()
+	lex.AddErrorListener(errListener)
+	tokens := antlr.NewCommonTokenStream(lex, 0)
+	p := parser.NewCypherParser(tokens)
+	p.RemoveErrorListeners()
+	p.AddErrorListener(errListener)
+	p.BuildParseTrees = true
+	tree := p.OC_Cypher()
+	if err := errListener.Err(); err != nil {
+		return nil, err
+	}
+
+	used := make(map[string]bool)
+	for _, v := range findAll[*parser.OC_VariableContext](tree) {
+		used[v.GetText()] = true
+	}
+
+	return &Rewriter{
+		tokens:     tokens,
+		tree:       tree,
+		rewriter:   antlr.NewTokenStreamRewriter(tokens),
+		used:       used,
+		variables:  make(map[antlr.ParserRuleContext]string),
+		predicates: make(map[antlr.ParserRuleContext][]string),
+	}, nil
+}
+
+// Returns the query text with all edits applied
+func (r *Rewriter) Text() string {
+	r.flushPredicates()
+
+	// Leave out the EOF token
+	return r.rewriter.GetText(antlr.DefaultProgramName, antlr.NewInterval(0, r.tokens.Size()-2))
+}
+
+// Removes every RETURN projection item and ORDER BY sort item that references one of the properties
+// In a UNION all parts must return the same columns, so the items are replaced with null instead
+// Returns the number of items removed or replaced
+func (r *Rewriter) RemoveProperties(props []Property) (int, error) {
+	returns := findAll[*parser.OC_ReturnContext](r.tree)
+	if len(returns) == 0 {
+		return 0, fmt.Errorf("no RETURN clause found")
+	}
+	isUnion := len(findAll[*parser.OC_UnionContext](r.tree)) > 0
+
+	edited := 0
+	for _, ret := range returns {
+		body := ret.OC_ProjectionBody()
+		if body == nil || body.OC_ProjectionItems() == nil {
+			continue
+		}
+
+		items := body.OC_ProjectionItems()
+		hasStar := false
+		for _, child := range items.GetChildren() {
+			if t, ok := child.(antlr.TerminalNode); ok && t.GetText() == "*" {
+				hasStar = true
+			}
+		}
+
+		var kept []string
+		removed := 0
+		removedAliases := make(map[string]bool)
+		for _, item := range items.AllOC_ProjectionItem() {
+			text := r.original(item)
+			if !References(item, props) {
+				kept = append(kept, text)
+				continue
+			}
+
+			removed++
+			column := QuoteName(text)
+			if alias := item.OC_Variable(); alias != nil {
+				column = alias.GetText()
+				removedAliases[column] = true
+			}
+
+			if isUnion {
+				log.Printf("Replacing field '%s' with null due to a disallowed property\n", text)
+				kept = append(kept, "null AS "+column)
+			} else {
+				log.Printf("Removing field '%s' due to a disallowed property\n", text)
+			}
+		}
+
+		if len(kept) == 0 && !hasStar {
+			return edited, fmt.Errorf("rewriting results in an empty RETURN clause")
+		}
+
+		if removed > 0 {
+			if hasStar {
+				kept = append([]string{"*"}, kept...)
+			}
+			r.replace(items, strings.Join(kept, ", "))
+			edited += removed
+		}
+
+		if order := body.OC_Order(); order != nil {
+			edited += r.removeSortItems(body, order, props, removedAliases)
+		}
+	}
+
+	return edited, nil
+}
+
+// Removes the sort items that reference one of the properties or an alias of a removed projection item
+// The whole ORDER BY is dropped if no sort items remain
+func (r *Rewriter) removeSortItems(body parser.IOC_ProjectionBodyContext, order parser.IOC_OrderContext, props []Property, removedAliases map[string]bool) int {
+	removed := 0
+	var kept []string
+	for _, item := range order.AllOC_SortItem() {
+		if References(item, props) || referencesVariable(item, removedAliases) {
+			log.Printf("Removing sort item '%s' due to a disallowed property\n", r.original(item))
+			removed++
+			continue
+		}
+		kept = append(kept, r.original(item))
+	}
+
+	if removed == 0 {
+		return 0
+	}
+
+	if len(kept) > 0 {
+		first := order.AllOC_SortItem()[0]
+		r.rewriter.ReplaceDefault(first.GetStart().GetTokenIndex(), order.GetStop().GetTokenIndex(), strings.Join(kept, ", "))
+		return removed
+	}
+
+	// Remove the ORDER BY along with the whitespace separating it from the projection items
+	start := order.GetStart().GetTokenIndex()
+	if prev := body.OC_ProjectionItems(); prev != nil {
+		start = prev.GetStop().GetTokenIndex() + 1
+	}
+	r.rewriter.DeleteDefault(start, order.GetStop().GetTokenIndex())
+	return removed
+}
+
+// Returns the lookups of the properties outside of RETURN clauses, e.g. in WHERE or WITH
+func (r *Rewriter) Leaks(props []Property) []string {
+	exprs, _ := r.leakingExpressions(props)
+	var leaks []string
+	for _, expr := range exprs {
+		leaks = append(leaks, r.original(expr))
+	}
+	return leaks
+}
+
+// Replaces every lookup of the properties outside of RETURN clauses with null
+// Lookups inside SET, REMOVE, CREATE, MERGE or a properties map cannot be neutralized and result in an error
+func (r *Rewriter) NeutralizeProperties(props []Property) error {
+	exprs, stops := r.leakingExpressions(props)
+	for _, expr := range exprs {
+		if hasAncestor[*parser.OC_SetItemContext](expr) || hasAncestor[*parser.OC_RemoveItemContext](expr) ||
+			hasAncestor[*parser.OC_CreateContext](expr) || hasAncestor[*parser.OC_MergeContext](expr) ||
+			hasAncestor[*parser.OC_PropertiesContext](expr) {
+			return fmt.Errorf("property '%s' is written or matched", r.original(expr))
+		}
+	}
+
+	for _, expr := range exprs {
+		log.Printf("Replacing '%s' with null due to a disallowed property\n", r.original(expr))
+		r.rewriter.ReplaceDefault(expr.GetStart().GetTokenIndex(), stops[expr], "null")
+	}
+
+	return nil
+}
+
+// Returns the expressions outside of RETURN clauses that contain a lookup of one of the properties,
+// along with the token index where the last such lookup in each expression ends
+func (r *Rewriter) leakingExpressions(props []Property) ([]antlr.ParserRuleContext, map[antlr.ParserRuleContext]int) {
+	var exprs []antlr.ParserRuleContext
+	stops := make(map[antlr.ParserRuleContext]int)
+	for _, lookup := range findAll[*parser.OC_PropertyLookupContext](r.tree) {
+		if !matches(lookup, props) || hasAncestor[*parser.OC_ReturnContext](lookup) {
+			continue
+		}
+
+		expr := lookup.GetParent().(antlr.ParserRuleContext)
+		if _, seen := stops[expr]; !seen {
+			exprs = append(exprs, expr)
+		}
+		// Lookups chained on the same atom (n.a.b) share an expression, so the last one decides how much is replaced
+		stops[expr] = lookup.GetStop().GetTokenIndex()
+	}
+	return exprs, stops
+}
+
+// Returns the original text of a parse-tree node, including any whitespace and comments inside it
+func (r *Rewriter) original(ctx antlr.ParserRuleContext) string {
+	return r.tokens.GetTextFromInterval(antlr.NewInterval(ctx.GetStart().GetTokenIndex(), ctx.GetStop().GetTokenIndex()))
+}
+
+// Replaces the text of a parse-tree node
+func (r *Rewriter) replace(ctx antlr.ParserRuleContext, text string) {
+	r.rewriter.ReplaceDefault(ctx.GetStart().GetTokenIndex(), ctx.GetStop().GetTokenIndex(), text)
+}
+
+// Reports whether the subtree contains a lookup of one of the properties
+func References(tree antlr.Tree, props []Property) bool {
+	for _, lookup := range findAll[*parser.OC_PropertyLookupContext](tree) {
+		if matches(lookup, props) {
+			return true
+		}
+	}
+	return false
+}
+
+// Reports whether the property lookup is a lookup of one of the properties
+func matches(lookup *parser.OC_PropertyLookupContext, props []Property) bool {
+	pkCtx := lookup.OC_PropertyKeyName()
+	if pkCtx == nil {
+		return false
+	}
+	name := strings.ToLower(analyzer.CanonicalName(pkCtx.GetText()))
+	variable := LookupVariable(lookup)
+	for _, prop := range props {
+		if strings.ToLower(prop.Name) == name && (prop.Variable == "" || prop.Variable == variable) {
+			return true
+		}
+	}
+	return false
+}
+
+// Reports whether the subtree references one of the variables
+func referencesVariable(tree antlr.Tree, variables map[string]bool) bool {
+	for _, atom := range findAll[*parser.OC_AtomContext](tree) {
+		if v := atom.OC_Variable(); v != nil && variables[v.GetText()] {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the variable a property lookup is performed on, e.g. 'n' for n.name
+// Chained lookups (n.a.b) and lookups on other expressions yield an empty string
+func LookupVariable(ctx *parser.OC_PropertyLookupContext) string {
+	var atom parser.IOC_AtomContext
+	var children []antlr.Tree
+	switch parent := ctx.GetParent().(type) {
+	case *parser.OC_PropertyExpressionContext:
+		atom = parent.OC_Atom()
+		children = parent.GetChildren()
+	case *parser.OC_NonArithmeticOperatorExpressionContext:
+		atom = parent.OC_Atom()
+		children = parent.GetChildren()
+	default:
+		return ""
+	}
+
+	if atom == nil || atom.OC_Variable() == nil {
+		return ""
+	}
+
+	// The lookup must directly follow the atom, ignoring whitespace
+	for _, child := range children[1:] {
+		if _, ok := child.(antlr.TerminalNode); ok {
+			continue
+		}
+		if child != ctx {
+			return ""
+		}
+		break
+	}
+
+	return atom.OC_Variable().GetText()
+}
+
+// Returns a name as a Cypher identifier, escaping it with backticks when needed
+func QuoteName(name string) string {
+	for i, c := range name {
+		isLetter := c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+		isDigit := c >= '0' && c <= '9'
+		if !isLetter && !(isDigit && i > 0) {
+			return "`" + strings.ReplaceAll(name, "`", "``") + "`"
+		}
+	}
+	if name == "" {
+		return "``"
+	}
+	return name
+}
+
+// Returns a string as a single-quoted Cypher string literal
+func QuoteString(value string) string {
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	value = strings.ReplaceAll(value, `'`, `\'`)
+	return "'" + value + "'"
+}
+
+// Returns the name of a procedure or function along with its namespace, e.g. db.labels, with each part canonicalized
+// so that quoting a part, e.g. `db`.`labels`, or escaping it does not change the name
+func QualifiedName(namespace parser.IOC_NamespaceContext, name parser.IOC_SymbolicNameContext) string {
+	var parts []string
+	if namespace != nil {
+		for _, part := range namespace.AllOC_SymbolicName() {
+			parts = append(parts, analyzer.CanonicalName(part.GetText()))
+		}
+	}
+	return strings.Join(append(parts, analyzer.CanonicalName(name.GetText())), ".")
+}
+
+// Returns all nodes of type T in the subtree, in the order they appear in the query
+func findAll[T antlr.Tree](tree antlr.Tree) []T {
+	var found []T
+	if t, ok := tree.(T); ok {
+		found = append(found, t)
+	}
+	for _, child := range tree.GetChildren() {
+		found = append(found, findAll[T](child)...)
+	}
+	return found
+}
+
+// Reports whether any ancestor of the node is of type T
+func hasAncestor[T antlr.Tree](tree antlr.Tree) bool {
+	for parent := tree.GetParent(); parent != nil; parent = parent.GetParent() {
+		if _, ok := parent.(T); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,419 @@
+package rewriter
+
+import (
+	"io"
+	"log"
+	"os"
+	"slices"
+	"testing"
+
+	"github.com/danielbahrami/se10-mt/internal/analyzer"
+	"github.com/danielbahrami/se10-mt/internal/postgres"
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+var ssn = []Property{{Name: "ssn"}}
+
+func TestRemoveProperties(t *testing.T) {
+	tests := []struct {
+		name    string
+		query   string
+		want    string
+		edited  int
+		wantErr bool
+	}{
+		{
+			name:   "property removed from RETURN",
+			query:  "MATCH (p:Patient) RETURN p.name, p.ssn",
+			want:   "MATCH (p:Patient) RETURN p.name",
+			edited: 1,
+		},
+		{
+			name:   "property removed through alias",
+			query:  "MATCH (p:Patient) WITH p AS q RETURN q.name, q.ssn",
+			want:   "MATCH (p:Patient) WITH p AS q RETURN q.name",
+			edited: 1,
+		},
+		{
+			name:   "property removed with comprehension",
+			query:  "MATCH (p:Patient) RETURN p.name, [x IN [p] WHERE x.ssn = '1' | x.name] AS names",
+			want:   "MATCH (p:Patient) RETURN p.name",
+			edited: 1,
+		},
+		{
+			name:   "sort item removed",
+			query:  "MATCH (p:Patient) RETURN p.name ORDER BY p.ssn",
+			want:   "MATCH (p:Patient) RETURN p.name",
+			edited: 1,
+		},
+		{
+			name:   "property replaced in UNION",
+			query:  "MATCH (p:Patient) RETURN p.ssn AS x UNION MATCH (e:Employee) RETURN e.name AS x",
+			want:   "MATCH (p:Patient) RETURN null AS x UNION MATCH (e:Employee) RETURN e.name AS x",
+			edited: 1,
+		},
+		{
+			name:    "empty RETURN",
+			query:   "MATCH (p:Patient) RETURN p.ssn",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := New(tt.query)
+			if err != nil {
+				t.Fatalf("New(%q) failed: %v", tt.query, err)
+			}
+			edited, err := r.RemoveProperties(ssn)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("RemoveProperties on %q succeeded with %q, want an error", tt.query, r.Text())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("RemoveProperties on %q failed: %v", tt.query, err)
+			}
+			if got := r.Text(); got != tt.want {
+				t.Errorf("RemoveProperties on %q = %q, want %q", tt.query, got, tt.want)
+			}
+			if edited != tt.edited {
+				t.Errorf("RemoveProperties on %q edited %d items, want %d", tt.query, edited, tt.edited)
+			}
+		})
+	}
+}
+
+func TestNeutralizeProperties(t *testing.T) {
+	tests := []struct {
+		name    string
+		query   string
+		want    string
+		wantErr bool
+	}{
+		{
+			name:  "property neutralized in WHERE",
+			query: "MATCH (p:Patient) WHERE p.ssn = '1' RETURN p.name",
+			want:  "MATCH (p:Patient) WHERE null = '1' RETURN p.name",
+		},
+		{
+			name:  "property neutralized in comprehension",
+			query: "MATCH (p:Patient) WITH [x IN [p] WHERE x.ssn = '1' | x] AS ps RETURN size(ps)",
+			want:  "MATCH (p:Patient) WITH [x IN [p] WHERE null = '1' | x] AS ps RETURN size(ps)",
+		},
+		{
+			name:    "property written",
+			query:   "MATCH (p:Patient) SET p.ssn = '1' RETURN p.name",
+			wantErr: true,
+		},
+		{
+			name:    "property written from",
+			query:   "MATCH (p:Patient) SET p.name = p.ssn RETURN p.name",
+			wantErr: true,
+		},
+		{
+			name:    "property matched",
+			query:   "MATCH (p:Patient) MATCH (e:Employee {name: p.ssn}) RETURN e.name",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := New(tt.query)
+			if err != nil {
+				t.Fatalf("New(%q) failed: %v", tt.query, err)
+			}
+			if len(r.Leaks(ssn)) == 0 {
+				t.Errorf("Leaks on %q found nothing", tt.query)
+			}
+			err = r.NeutralizeProperties(ssn)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("NeutralizeProperties on %q succeeded with %q, want an error", tt.query, r.Text())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("NeutralizeProperties on %q failed: %v", tt.query, err)
+			}
+			if got := r.Text(); got != tt.want {
+				t.Errorf("NeutralizeProperties on %q = %q, want %q", tt.query, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRewriteQuery(t *testing.T) {
+	property := analyzer.Violation{Kind: analyzer.ViolationProperty, Property: "ssn"}
+	tests := []struct {
+		name          string
+		query         string
+		violations    []analyzer.Violation
+		strictness    string
+		want          string
+		wantRewritten bool
+		wantErr       bool
+	}{
+		{
+			name:          "property removed",
+			query:         "MATCH (p:Patient) RETURN p.name, p.ssn",
+			violations:    []analyzer.Violation{property},
+			strictness:    postgres.StrictnessStrict,
+			want:          "MATCH (p:Patient) RETURN p.name",
+			wantRewritten: true,
+		},
+		{
+			name:          "property neutralized",
+			query:         "MATCH (p:Patient) WHERE p.ssn = '1' RETURN p.name",
+			violations:    []analyzer.Violation{property},
+			strictness:    postgres.StrictnessRewrite,
+			want:          "MATCH (p:Patient) WHERE null = '1' RETURN p.name",
+			wantRewritten: true,
+		},
+		{
+			name:       "property outside of RETURN in strict mode",
+			query:      "MATCH (p:Patient) WHERE p.ssn = '1' RETURN p.name",
+			violations: []analyzer.Violation{property},
+			strictness: postgres.StrictnessStrict,
+			wantErr:    true,
+		},
+		{
+			name:       "property not looked up",
+			query:      "MATCH (p:Patient) RETURN p.name",
+			violations: []analyzer.Violation{property},
+			strictness: postgres.StrictnessRewrite,
+			want:       "MATCH (p:Patient) RETURN p.name",
+		},
+		{
+			name:       "property not looked up in strict mode",
+			query:      "MATCH (p:Patient) RETURN p.name",
+			violations: []analyzer.Violation{property},
+			strictness: postgres.StrictnessStrict,
+			wantErr:    true,
+		},
+		{
+			name:       "other violation",
+			query:      "MATCH (s:Secret) RETURN s.name",
+			violations: []analyzer.Violation{{Kind: analyzer.ViolationLabel, Entity: "Secret"}},
+			strictness: postgres.StrictnessRewrite,
+			wantErr:    true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, rewritten, err := RewriteQuery(tt.query, tt.violations, tt.strictness)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("RewriteQuery(%q) = %q, want an error", tt.query, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("RewriteQuery(%q) failed: %v", tt.query, err)
+			}
+			if got != tt.want || rewritten != tt.wantRewritten {
+				t.Errorf("RewriteQuery(%q) = %q, %v, want %q, %v", tt.query, got, rewritten, tt.want, tt.wantRewritten)
+			}
+		})
+	}
+}
+
+func TestConstrainPatterns(t *testing.T) {
+	labels, relTypes := []string{"Patient", "Employee"}, []string{"TREATS"}
+
+	tests := []struct {
+		name         string
+		query        string
+		deniedLabels []string
+		want         string
+	}{
+		{
+			name:  "unlabelled node",
+			query: "MATCH (n) RETURN n.name",
+			want:  "MATCH (n) WHERE (n:Patient OR n:Employee) RETURN n.name",
+		},
+		{
+			name:  "untyped relationship",
+			query: "MATCH (e:Employee)-[r]->(p:Patient) RETURN p.name",
+			want:  "MATCH (e:Employee)-[r]->(p:Patient) WHERE type(r) IN ['TREATS'] RETURN p.name",
+		},
+		{
+			name:  "labelled pattern",
+			query: "MATCH (e:Employee)-[:TREATS]->(p:Patient) RETURN p.name",
+			want:  "MATCH (e:Employee)-[:TREATS]->(p:Patient) RETURN p.name",
+		},
+		{
+			name:  "anonymous nodes and relationships",
+			query: "MATCH (e:Employee)-->() RETURN e.name",
+			want:  "MATCH (e:Employee)-[_r0]->(_n0) WHERE (_n0:Patient OR _n0:Employee) AND type(_r0) IN ['TREATS'] RETURN e.name",
+		},
+		{
+			name:         "denied labels",
+			query:        "MATCH (n) RETURN n.name",
+			deniedLabels: []string{"SECRET", "Priv*"},
+			want:         "MATCH (n) WHERE (n:Patient OR n:Employee) AND NOT any(_l0 IN labels(n) WHERE toLower(_l0) = 'secret' OR toLower(_l0) =~ 'priv.*') RETURN n.name",
+		},
+		{
+			name:         "denied labels on labelled pattern",
+			query:        "MATCH (p:Patient) RETURN p.name",
+			deniedLabels: []string{"Secret"},
+			want:         "MATCH (p:Patient) RETURN p.name",
+		},
+		{
+			name:  "pattern comprehension",
+			query: "MATCH (e:Employee) RETURN [(e)-->(p) | p.name]",
+			want:  "MATCH (e:Employee) RETURN [(e)-[_r0]->(p) WHERE (e:Patient OR e:Employee) AND (p:Patient OR p:Employee) AND type(_r0) IN ['TREATS'] | p.name]",
+		},
+		{
+			name:  "pattern predicate",
+			query: "MATCH (e:Employee) WHERE (e)-[:TREATS]->() RETURN e.name",
+			want:  "MATCH (e:Employee) WHERE EXISTS { (e)-[:TREATS]->(_n0) WHERE (e:Patient OR e:Employee) AND (_n0:Patient OR _n0:Employee) } RETURN e.name",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := New(tt.query)
+			if err != nil {
+				t.Fatalf("New(%q) failed: %v", tt.query, err)
+			}
+			r.ConstrainPatterns(labels, relTypes, tt.deniedLabels)
+			if got := r.Text(); got != tt.want {
+				t.Errorf("ConstrainPatterns on %q = %q, want %q", tt.query, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestApplyRowFilters(t *testing.T) {
+	labelFilters := map[string][]string{"Patient": {"n.department = $user.department"}}
+	relFilters := map[string][]string{"TREATS": {"n.active"}}
+
+	tests := []struct {
+		name    string
+		query   string
+		want    string
+		wantErr bool
+	}{
+		{
+			name:  "labelled node",
+			query: "MATCH (p:Patient) RETURN p.name",
+			want:  "MATCH (p:Patient) WHERE (p.department = $user.department) RETURN p.name",
+		},
+		{
+			name:  "unlabelled node",
+			query: "MATCH (n) RETURN n.name",
+			want:  "MATCH (n) WHERE (NOT any(_l0 IN labels(n) WHERE toLower(_l0) = 'patient') OR (n.department = $user.department)) RETURN n.name",
+		},
+		{
+			name:  "existing WHERE clause",
+			query: "MATCH (p:Patient) WHERE p.age > 18 RETURN p.name",
+			want:  "MATCH (p:Patient) WHERE (p.age > 18) AND (p.department = $user.department) RETURN p.name",
+		},
+		{
+			name:  "relationship",
+			query: "MATCH (e:Employee)-[r:TREATS]->(p:Patient) RETURN p.name",
+			want:  "MATCH (e:Employee)-[r:TREATS]->(p:Patient) WHERE (p.department = $user.department) AND (r.active) RETURN p.name",
+		},
+		{
+			name:  "untyped relationship",
+			query: "MATCH (e:Employee)-[r]->(p:Patient) RETURN p.name",
+			want:  "MATCH (e:Employee)-[r]->(p:Patient) WHERE (p.department = $user.department) AND (toLower(type(r)) <> 'treats' OR (r.active)) RETURN p.name",
+		},
+		{
+			name:  "variable length relationship",
+			query: "MATCH (e:Employee)-[r:TREATS*1..2]->(p:Patient) RETURN p.name",
+			want: "MATCH (e:Employee)-[r:TREATS*1..2]->(p:Patient) WHERE (p.department = $user.department) AND all(_r0 IN r WHERE (_r0.active)) AND " +
+				"all(_r1 IN r WHERE (NOT any(_l0 IN labels(startNode(_r1)) WHERE toLower(_l0) = 'patient') OR (startNode(_r1).department = $user.department)) AND " +
+				"(NOT any(_l1 IN labels(endNode(_r1)) WHERE toLower(_l1) = 'patient') OR (endNode(_r1).department = $user.department))) RETURN p.name",
+		},
+		{
+			name:    "pattern in MERGE",
+			query:   "MERGE (p:Patient {name: 'x'}) RETURN p.name",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := New(tt.query)
+			if err != nil {
+				t.Fatalf("New(%q) failed: %v", tt.query, err)
+			}
+			_, err = r.ApplyRowFilters(labelFilters, relFilters)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("ApplyRowFilters on %q succeeded with %q, want an error", tt.query, r.Text())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ApplyRowFilters on %q failed: %v", tt.query, err)
+			}
+			if got := r.Text(); got != tt.want {
+				t.Errorf("ApplyRowFilters on %q = %q, want %q", tt.query, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFindDynamicAccesses(t *testing.T) {
+	type access struct {
+		variable, key string
+		computed      bool
+	}
+
+	tests := []struct {
+		name  string
+		query string
+		want  []access
+	}{
+		{
+			name:  "literal key",
+			query: "MATCH (p:Patient) RETURN p['ssn']",
+			want:  []access{{variable: "p", key: "ssn"}},
+		},
+		{
+			name:  "computed key",
+			query: "MATCH (p:Patient) RETURN p[$key]",
+			want:  []access{{variable: "p", computed: true}},
+		},
+		{
+			name:  "literal list",
+			query: "UNWIND [0, 1] AS i RETURN ['a', 'b'][i]",
+		},
+		{
+			name:  "literal list holding a variable",
+			query: "MATCH (p:Patient) RETURN [p][0]['ssn']",
+			want:  []access{{key: "ssn", computed: true}},
+		},
+		{
+			name:  "literal map holding a variable",
+			query: "MATCH (p:Patient) RETURN {a: p}['a']['ssn']",
+			want:  []access{{key: "a", computed: true}, {key: "ssn", computed: true}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := New(tt.query)
+			if err != nil {
+				t.Fatalf("New(%q) failed: %v", tt.query, err)
+			}
+			var got []access
+			for _, a := range FindDynamicAccesses(r.tree) {
+				got = append(got, access{variable: a.Variable, key: a.Key, computed: a.Computed})
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("FindDynamicAccesses on %q = %+v, want %+v", tt.query, got, tt.want)
+			}
+		})
+	}
+}